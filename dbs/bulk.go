@@ -0,0 +1,203 @@
+package dbs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxParams is the most parameters a statement built by [BulkInsert]
+// has unless configured otherwise with [WithMaxParams]. It is the limit of
+// SQLite before 3.32.
+const DefaultMaxParams = 999
+
+// WithMaxParams sets the most parameters a statement built by [BulkInsert]
+// may have, e.g. 32766 for recent SQLite or 65535 for Postgres.
+func WithMaxParams(n int) Option {
+	return func(db *DB) {
+		db.bulk.maxParams = n
+	}
+}
+
+// WithCopyIn makes [BulkInsert] use the bulk loading of the driver, where
+// preparing the statement returned by copyIn, executing it once per row and
+// once more without arguments loads the rows, as with lib/pq:
+//
+//	dbs.WithCopyIn(pq.CopyIn)
+func WithCopyIn(copyIn func(table string, columns ...string) string) Option {
+	return func(db *DB) {
+		db.bulk.copyIn = copyIn
+	}
+}
+
+type bulkConfig struct {
+	maxParams int
+	copyIn    func(table string, columns ...string) string
+}
+
+// BulkInsert inserts rows into the columns of table and returns how many it
+// inserted. Each row has a value per column. Rows are inserted with
+// multi-row INSERT statements of as many rows as [WithMaxParams] allows, or
+// through the driver's bulk loading if configured with [WithCopyIn].
+//
+// On a [*DB] the rows are inserted in a transaction of their own, unless ctx
+// carries one, see [WithTxContext], on a [*Tx] in that transaction, so either
+// way they are inserted all or none.
+func BulkInsert(ctx context.Context, q Querier, table string, columns []string, rows iter.Seq[[]any]) (n int64, err error) {
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("bulk insert into %s: no columns", table)
+	}
+
+	switch q := q.(type) {
+	case *DB:
+		if tx := q.txFrom(ctx); tx != nil {
+			return bulkInsert(ctx, tx, table, columns, rows)
+		}
+		err = q.WithTx(ctx, nil, func(ctx context.Context, tx *Tx) error {
+			n, err = bulkInsert(ctx, tx, table, columns, rows)
+			return err
+		})
+		return n, err
+	case *Tx:
+		return bulkInsert(ctx, q, table, columns, rows)
+	case *Savepoint:
+		return bulkInsert(ctx, q.tx, table, columns, rows)
+	case *Queries:
+		// E.g. from DB.Q, which runs on a *DB or a *Tx.
+		if inner, ok := q.stmts.(Querier); ok {
+			return BulkInsert(ctx, inner, table, columns, rows)
+		}
+		return 0, fmt.Errorf("bulk insert into %s: unsupported querier %T", table, q.stmts)
+	default:
+		return 0, fmt.Errorf("bulk insert into %s: unsupported querier %T", table, q)
+	}
+}
+
+func bulkInsert(ctx context.Context, tx *Tx, table string, columns []string, rows iter.Seq[[]any]) (int64, error) {
+	cfg := tx.db.bulk
+	if cfg.copyIn != nil {
+		return copyIn(ctx, tx, cfg.copyIn(table, columns...), table, columns, rows)
+	}
+
+	var (
+		n       int64
+		perStmt = max(cfg.maxParams/len(columns), 1)
+		args    = make([]any, 0, perStmt*len(columns))
+	)
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+
+		stmt, err := tx.stmt(ctx, insertQuery(tx.hooks.dialect, table, columns, len(args)/len(columns)))
+		if err != nil {
+			return err
+		}
+		res, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		n += affected
+		args = args[:0]
+		return nil
+	}
+
+	for row := range rows {
+		if len(row) != len(columns) {
+			return n, fmt.Errorf("bulk insert into %s: row has %d values for %d columns", table, len(row), len(columns))
+		}
+		for _, v := range row {
+			args = append(args, sql.Named("p"+strconv.Itoa(len(args)+1), v))
+		}
+
+		if len(args) == cap(args) {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, flush()
+}
+
+// insertQuery builds an INSERT of rows rows of columns in dialect d, with
+// numbered parameters so that the query is the same for every chunk of the
+// same size.
+func insertQuery(d Dialect, table string, columns []string, rows int) string {
+	var b strings.Builder
+
+	b.WriteString("INSERT INTO ")
+	b.WriteString(d.quoteIdent(table))
+	b.WriteString(" (")
+	for i, col := range columns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(d.quoteIdent(col))
+	}
+	b.WriteString(") VALUES ")
+
+	for r := range rows {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for c := range columns {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("@p")
+			b.WriteString(strconv.Itoa(r*len(columns) + c + 1))
+		}
+		b.WriteByte(')')
+	}
+
+	return b.String()
+}
+
+// quoteIdent quotes name as an identifier of the dialect, with backticks for
+// MySQL, which takes double quotes for strings by default.
+func (d Dialect) quoteIdent(name string) string {
+	q := `"`
+	if d == DialectMySQL {
+		q = "`"
+	}
+	return q + strings.ReplaceAll(name, q, q+q) + q
+}
+
+// copyIn loads rows with the driver's bulk loading statement query.
+func copyIn(ctx context.Context, tx *Tx, query, table string, columns []string, rows iter.Seq[[]any]) (n int64, err error) {
+	err = tx.hooks.run(ctx, OpExec, query, nil, func(ctx context.Context, info *QueryInfo) error {
+		stmt, err := tx.tx.PrepareContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for row := range rows {
+			if len(row) != len(columns) {
+				return fmt.Errorf("bulk insert into %s: row has %d values for %d columns", table, len(row), len(columns))
+			}
+			if _, err := stmt.ExecContext(ctx, row...); err != nil {
+				return err
+			}
+			n++
+		}
+
+		// Executing without arguments flushes the rows.
+		if _, err := stmt.ExecContext(ctx); err != nil {
+			return err
+		}
+		info.RowsAffected = n
+		return nil
+	})
+	return n, err
+}
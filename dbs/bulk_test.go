@@ -0,0 +1,19 @@
+package dbs
+
+import "testing"
+
+func TestInsertQuery(t *testing.T) {
+	for _, tt := range []struct {
+		dialect Dialect
+		want    string
+	}{
+		{DialectSQLite, `INSERT INTO "user ""data""" ("id", "na` + "`" + `me") VALUES (@p1, @p2), (@p3, @p4)`},
+		{DialectPostgres, `INSERT INTO "user ""data""" ("id", "na` + "`" + `me") VALUES ($1, $2), ($3, $4)`},
+		{DialectMySQL, "INSERT INTO `user \"data\"` (`id`, `na``me`) VALUES (?, ?), (?, ?)"},
+	} {
+		got := (&hooks{dialect: tt.dialect}).placeholders(insertQuery(tt.dialect, `user "data"`, []string{"id", "na`me"}, 2)).query
+		if got != tt.want {
+			t.Errorf("dialect %d: expected %s, got %s", tt.dialect, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+// Command dbs-gen generates [dbs.Queries] methods from annotated .sql files.
+//
+// Every query in the input files is preceded by an annotation naming the
+// method and what it returns:
+//
+//	-- name: FindUsersByLastName :many
+//	SELECT id, first_name FROM users WHERE last_name = @last_name;
+//
+// The kinds are :one (a single row), :many (all rows), :exec (nothing),
+// :execrows (the number of affected rows) and :execlastid (the last inserted
+// id). Parameters are the @name placeholders in order of appearance, result
+// columns come from preparing the query against the -schema. Types are
+// inferred from the schema's column declarations and can be overridden with
+//
+//	-- param: last_name string
+//	-- column: n int64
+//
+// lines after the name annotation. Generated methods run wherever their
+// [dbs.Queries] do, on a replica only when called through [dbs.DB.Replica].
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/ek-os/dbs/internal/lex"
+	_ "github.com/mattn/go-sqlite3" // import sqlite3 driver
+)
+
+func main() {
+	var (
+		schema = flag.String("schema", "schema.sql", "file with the CREATE TABLE statements the queries run against")
+		out    = flag.String("o", "queries_gen.go", "output file")
+		pkg    = flag.String("pkg", "dbs", "package of the output file")
+	)
+	flag.Parse()
+
+	if err := run(*schema, *out, *pkg, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "dbs-gen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(schemaPath, out, pkg string, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("usage: dbs-gen [flags] <queries.sql>...")
+	}
+
+	schema, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return err
+	}
+
+	var queries []query
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		qs, err := parse(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		queries = append(queries, qs...)
+	}
+
+	src, err := generate(string(schema), pkg, queries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, src, 0o644)
+}
+
+type query struct {
+	name      string
+	kind      string
+	sql       string
+	paramType map[string]string
+	colType   map[string]string
+}
+
+var (
+	nameRe     = regexp.MustCompile(`^--\s*name:\s*([A-Z][A-Za-z0-9]*)\s+:(one|many|exec|execrows|execlastid)\s*$`)
+	overrideRe = regexp.MustCompile(`^--\s*(param|column):\s*([A-Za-z_][A-Za-z0-9_]*)\s+(\S+)\s*$`)
+)
+
+// parse splits an annotated .sql file into its queries.
+func parse(f *os.File) ([]query, error) {
+	var (
+		queries []query
+		cur     *query
+		body    strings.Builder
+		s       = bufio.NewScanner(f)
+	)
+	flush := func() {
+		if cur != nil {
+			cur.sql = strings.TrimSuffix(strings.TrimSpace(body.String()), ";")
+			queries = append(queries, *cur)
+		}
+		body.Reset()
+	}
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if m := nameRe.FindStringSubmatch(line); m != nil {
+			flush()
+			cur = &query{
+				name:      m[1],
+				kind:      m[2],
+				paramType: map[string]string{},
+				colType:   map[string]string{},
+			}
+			continue
+		}
+		if cur == nil {
+			if line != "" && !strings.HasPrefix(line, "--") {
+				return nil, fmt.Errorf("line %d: query without a name annotation", n)
+			}
+			continue
+		}
+		if m := overrideRe.FindStringSubmatch(line); m != nil && body.Len() == 0 {
+			if m[1] == "param" {
+				cur.paramType[m[2]] = m[3]
+			} else {
+				cur.colType[m[2]] = m[3]
+			}
+			continue
+		}
+		body.WriteString(s.Text())
+		body.WriteByte('\n')
+	}
+	flush()
+
+	return queries, s.Err()
+}
+
+type method struct {
+	Name    string
+	Kind    string
+	SQL     string
+	Params  []field
+	Columns []field
+	Row     string
+}
+
+// Elem is the type of a returned row.
+func (m method) Elem() string {
+	if m.Row != "" {
+		return m.Row
+	}
+	return m.Columns[0].Type
+}
+
+// Results is the result list of the method.
+func (m method) Results() string {
+	switch m.Kind {
+	case "one":
+		if m.Row != "" {
+			return "*" + m.Row + ", error"
+		}
+		return m.Elem() + ", error"
+	case "many":
+		return "[]" + m.Elem() + ", error"
+	case "exec":
+		return "error"
+	default:
+		return "int64, error"
+	}
+}
+
+// Zero is the value returned alongside an error, without the error.
+func (m method) Zero() string {
+	switch m.Kind {
+	case "one":
+		if m.Row != "" {
+			return "nil"
+		}
+		return zero(m.Elem())
+	case "many":
+		return "nil"
+	case "exec":
+		return ""
+	default:
+		return "0"
+	}
+}
+
+func zero(typ string) string {
+	switch typ {
+	case "int64", "float64":
+		return "0"
+	case "string":
+		return `""`
+	case "bool":
+		return "false"
+	case "[]byte":
+		return "nil"
+	default:
+		return typ + "{}"
+	}
+}
+
+type field struct {
+	Name   string // name in SQL
+	GoName string // exported Go name
+	Var    string // unexported Go name
+	Type   string
+}
+
+func generate(schema, pkg string, queries []query) ([]byte, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("load schema: %w", err)
+	}
+
+	cols, err := schemaColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		methods []method
+		imports = map[string]bool{"context": true}
+	)
+	for _, q := range queries {
+		m, err := newMethod(db, cols, q)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", q.name, err)
+		}
+		if len(m.Params) > 0 {
+			imports["database/sql"] = true
+		}
+		for _, f := range append(m.Params, m.Columns...) {
+			if strings.Contains(f.Type, "sql.") {
+				imports["database/sql"] = true
+			}
+			if strings.Contains(f.Type, "time.Time") {
+				imports["time"] = true
+			}
+		}
+		methods = append(methods, m)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct {
+		Package string
+		Imports map[string]bool
+		Methods []method
+	}{pkg, imports, methods}); err != nil {
+		return nil, err
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %w\n%s", err, buf.Bytes())
+	}
+	return src, nil
+}
+
+func newMethod(db *sql.DB, cols map[string][]column, q query) (method, error) {
+	m := method{Name: q.name, Kind: q.kind, SQL: q.sql}
+
+	seen := map[string]bool{}
+	// The queries are prepared against SQLite, so they are lexed as SQLite.
+	for _, p := range lex.Placeholders(q.sql, lex.SQLite) {
+		name := p.Name
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		typ, ok := q.paramType[name]
+		if !ok {
+			if typ, ok = inferType(cols[name]); !ok {
+				return m, fmt.Errorf("can't infer type of @%s, add a '-- param: %s <type>' line", name, name)
+			}
+		}
+		m.Params = append(m.Params, newField(name, typ))
+	}
+
+	if q.kind != "one" && q.kind != "many" {
+		return m, nil
+	}
+
+	// Preparing isn't enough to learn the columns, the query has to run.
+	// With every parameter NULL it is cheap and there's no data anyway.
+	args := make([]any, len(m.Params))
+	for i, p := range m.Params {
+		args[i] = sql.Named(p.Name, nil)
+	}
+	rows, err := db.Query(q.sql, args...)
+	if err != nil {
+		return m, err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return m, err
+	}
+	for _, ct := range types {
+		typ, ok := q.colType[ct.Name()]
+		if !ok {
+			if typ, ok = columnType(ct.DatabaseTypeName(), cols[ct.Name()]); !ok {
+				return m, fmt.Errorf("can't infer type of column %s, add a '-- column: %s <type>' line", ct.Name(), ct.Name())
+			}
+		}
+		m.Columns = append(m.Columns, newField(ct.Name(), typ))
+	}
+	if len(m.Columns) > 1 {
+		m.Row = q.name + "Row"
+	}
+
+	return m, nil
+}
+
+type column struct {
+	declType string
+	notNull  bool
+}
+
+// schemaColumns returns every column of every table in the schema by name.
+func schemaColumns(db *sql.DB) (map[string][]column, error) {
+	rows, err := db.Query(`
+		SELECT c.name, c.type, c."notnull" OR c.pk
+		FROM sqlite_master t, pragma_table_info(t.name) c
+		WHERE t.type = 'table'
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := map[string][]column{}
+	for rows.Next() {
+		var (
+			name string
+			c    column
+		)
+		if err := rows.Scan(&name, &c.declType, &c.notNull); err != nil {
+			return nil, err
+		}
+		cols[name] = append(cols[name], c)
+	}
+	return cols, rows.Err()
+}
+
+// inferType returns the Go type of a parameter compared against one of cols.
+func inferType(cols []column) (string, bool) {
+	if len(cols) == 0 {
+		return "", false
+	}
+	typ := goType(cols[0].declType)
+	for _, c := range cols[1:] {
+		if goType(c.declType) != typ {
+			return "", false
+		}
+	}
+	return typ, typ != ""
+}
+
+// columnType returns the Go type of a result column with the given declared
+// type. It is nullable unless every schema column with its name is NOT NULL.
+func columnType(declType string, cols []column) (string, bool) {
+	typ := goType(declType)
+	if typ == "" {
+		return "", false
+	}
+
+	notNull := len(cols) > 0
+	for _, c := range cols {
+		notNull = notNull && c.notNull
+	}
+	if !notNull {
+		typ = "sql.Null[" + typ + "]"
+	}
+	return typ, true
+}
+
+// goType follows SQLite's rules for determining column affinity.
+func goType(declType string) string {
+	t := strings.ToUpper(declType)
+	switch {
+	case t == "":
+		return ""
+	case strings.Contains(t, "INT"):
+		return "int64"
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return "string"
+	case strings.Contains(t, "BLOB"):
+		return "[]byte"
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return "float64"
+	case strings.Contains(t, "BOOL"):
+		return "bool"
+	case strings.Contains(t, "DATE"), strings.Contains(t, "TIME"):
+		return "time.Time"
+	default:
+		return ""
+	}
+}
+
+var initialisms = map[string]string{"id": "ID", "url": "URL", "uuid": "UUID", "json": "JSON", "api": "API"}
+
+func newField(name, typ string) field {
+	parts := strings.Split(name, "_")
+	for i, p := range parts {
+		if up, ok := initialisms[strings.ToLower(p)]; ok {
+			parts[i] = up
+		} else if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	goName := strings.Join(parts, "")
+
+	v := strings.ToLower(goName[:1]) + goName[1:]
+	if up, ok := initialisms[strings.ToLower(parts[0])]; ok {
+		v = strings.ToLower(up) + strings.Join(parts[1:], "")
+	}
+
+	return field{Name: name, GoName: goName, Var: v, Type: typ}
+}
+
+var tmpl = template.Must(template.New("").Funcs(template.FuncMap{
+	"quote": func(s string) string {
+		if strings.Contains(s, "`") {
+			return fmt.Sprintf("%q", s)
+		}
+		return "`" + s + "`"
+	},
+}).Parse(`// Code generated by dbs-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range $path, $_ := .Imports}}
+	"{{$path}}"
+{{- end}}
+)
+{{range .Methods}}
+{{- if .Row}}
+type {{.Row}} struct {
+{{- range .Columns}}
+	{{.GoName}} {{.Type}}
+{{- end}}
+}
+{{end}}
+func (q *Queries) {{.Name}}(ctx context.Context{{range .Params}}, {{.Var}} {{.Type}}{{end}}) ({{.Results}}) {
+	stmt, err := q.stmts.stmt(ctx, {{quote .SQL}})
+	if err != nil {
+		return {{with .Zero}}{{.}}, {{end}}err
+	}
+{{if eq .Kind "one"}}
+	var r {{.Elem}}
+	if err := stmt.QueryRowContext(ctx{{template "args" .}}).
+		Scan({{template "dests" .}}); err != nil {
+		return {{.Zero}}, err
+	}
+
+	return {{if .Row}}&r{{else}}r{{end}}, nil
+{{- else if eq .Kind "many"}}
+	rows, err := stmt.QueryContext(ctx{{template "args" .}})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []{{.Elem}}
+	for rows.Next() {
+		var r {{.Elem}}
+		if err := rows.Scan({{template "dests" .}}); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+
+	return res, rows.Err()
+{{- else if eq .Kind "exec"}}
+	_, err = stmt.ExecContext(ctx{{template "args" .}})
+	return err
+{{- else}}
+	res, err := stmt.ExecContext(ctx{{template "args" .}})
+	if err != nil {
+		return 0, err
+	}
+	return res.{{if eq .Kind "execrows"}}RowsAffected{{else}}LastInsertId{{end}}()
+{{- end}}
+}
+{{end}}
+{{- define "args"}}{{range .Params}}, sql.Named("{{.Name}}", {{.Var}}){{end}}{{end}}
+{{- define "dests"}}{{range $i, $c := .Columns}}{{if $i}}, {{end}}&r{{if $.Row}}.{{$c.GoName}}{{end}}{{end}}{{end}}
+`))
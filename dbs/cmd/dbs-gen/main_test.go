@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGeneratedQueriesUpToDate(t *testing.T) {
+	schema, err := os.ReadFile("../../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open("../../queries.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	queries, err := parse(f)
+	if err != nil {
+		t.Fatalf("failed to parse queries: %s", err)
+	}
+
+	got, err := generate(string(schema), "dbs", queries)
+	if err != nil {
+		t.Fatalf("failed to generate: %s", err)
+	}
+
+	want, err := os.ReadFile("../../queries_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(want) {
+		t.Errorf("queries_gen.go is out of date, run go generate")
+	}
+}
+
+func TestGenerateFailsOnUnknownType(t *testing.T) {
+	queries := []query{{
+		name:      "CountUsers",
+		kind:      "one",
+		sql:       "SELECT count(*) FROM users WHERE first_name <> @nickname",
+		paramType: map[string]string{"nickname": "string"},
+		colType:   map[string]string{},
+	}}
+
+	_, err := generate("CREATE TABLE users (first_name TEXT NOT NULL);", "dbs", queries)
+	if err == nil || !strings.Contains(err.Error(), "can't infer type of column count(*)") {
+		t.Errorf("expected column type error, got: %v", err)
+	}
+}
+
+func TestGenerateSkipsQuotedPlaceholders(t *testing.T) {
+	m, err := newMethod(nil, map[string][]column{}, query{
+		name:      "DeleteExampleUsers",
+		kind:      "exec",
+		sql:       "DELETE FROM users WHERE email LIKE '%@example.com' AND id > @id -- but not @admin",
+		paramType: map[string]string{"id": "int64"},
+	})
+	if err != nil {
+		t.Fatalf("failed to generate: %s", err)
+	}
+	if len(m.Params) != 1 || m.Params[0].Name != "id" {
+		t.Errorf("expected only the id param, got %+v", m.Params)
+	}
+}
@@ -3,28 +3,107 @@ package dbs
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"math/rand/v2"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func New(db *sql.DB) *DB {
+func New(db *sql.DB, opts ...Option) *DB {
 	res := &DB{
-		db:    db,
-		stmts: new(sync.Map),
+		isRetryable: IsSerializationFailure,
+		hooks: &hooks{
+			translators: defaultTranslators,
+		},
+		bulk:                bulkConfig{maxParams: DefaultMaxParams},
+		stmtCacheSize:       DefaultStmtCacheSize,
+		healthCheckInterval: DefaultHealthCheckInterval,
 	}
+	for _, opt := range opts {
+		opt(res)
+	}
+
+	res.primary = newPool(db, res.stmtCacheSize, res.hooks)
+	for _, replica := range res.replicaDBs {
+		res.replicas = append(res.replicas, newPool(replica, res.stmtCacheSize, res.hooks))
+	}
+	for _, tune := range res.tuning {
+		tune(db)
+		for _, replica := range res.replicaDBs {
+			tune(replica)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res.stop = cancel
+	if len(res.replicas) > 0 {
+		go res.checkReplicas(ctx)
+	}
+
 	res.Queries = &Queries{stmts: res}
+	res.replica = &Queries{stmts: replica{res}}
 	return res
 }
 
 type DB struct {
-	db    *sql.DB
-	stmts *sync.Map
+	primary     *pool
+	replicas    []*pool
+	nextReplica atomic.Uint64
+	replica     *Queries
+	stop        context.CancelFunc
+
+	isRetryable func(error) bool
+	hooks       *hooks
+	bulk        bulkConfig
+
+	// Transactions in flight, so that Shutdown can wait for them.
+	txMu     sync.Mutex
+	txs      int
+	shutdown bool
+	drained  chan struct{} // Closed once txs is 0 after Shutdown.
+
+	// Options only needed to set up the pools.
+	stmtCacheSize       int
+	replicaDBs          []*sql.DB
+	healthCheckInterval time.Duration
+	tuning              []func(*sql.DB)
+
 	*Queries
 }
 
+// Option configures a [DB] created by [New].
+type Option func(*DB)
+
+// WithRetryable sets how [DB.WithTx] recognizes errors after which the
+// transaction is worth retrying, [IsSerializationFailure] by default.
+func WithRetryable(isRetryable func(err error) bool) Option {
+	return func(db *DB) {
+		db.isRetryable = isRetryable
+	}
+}
+
+// IsSerializationFailure reports whether err carries the SQLSTATE of a
+// serialization failure or a deadlock, as reported by Postgres drivers.
+func IsSerializationFailure(err error) bool {
+	var e interface{ SQLState() string }
+	if errors.As(err, &e) {
+		switch e.SQLState() {
+		case "40001", "40P01":
+			return true
+		}
+	}
+	return false
+}
+
 // Avoid imports to database/sql in code creating transactions
 type TxOptions struct {
 	Isolation IsolationLevel
 	ReadOnly  bool
+
+	// Retries is how many more times [DB.WithTx] runs the callback when
+	// the transaction fails with a retryable error.
+	Retries int
 }
 
 // IsolationLevel is the transaction isolation level used in [TxOptions].
@@ -42,51 +121,225 @@ const (
 )
 
 func (db *DB) Begin() (*Tx, error) {
-	tx, err := db.db.Begin()
-	if err != nil {
-		return nil, err
-	}
-	return newTx(db, tx), nil
+	return db.BeginTx(context.Background(), nil)
 }
 
 func (db *DB) BeginTx(ctx context.Context, opts *TxOptions) (*Tx, error) {
-	var txopts *sql.TxOptions
+	var (
+		txopts *sql.TxOptions
+		p      = db.primary
+	)
 	if opts != nil {
 		txopts = &sql.TxOptions{
 			Isolation: sql.IsolationLevel(opts.Isolation),
 			ReadOnly:  opts.ReadOnly,
 		}
+		if opts.ReadOnly {
+			p = db.readPool()
+		}
+	}
+
+	done, err := db.txStarted()
+	if err != nil {
+		return nil, err
 	}
 
-	tx, err := db.db.BeginTx(ctx, txopts)
+	tx, err := p.db.BeginTx(ctx, txopts)
 	if err != nil {
+		done()
 		return nil, err
 	}
 
-	return newTx(db, tx), nil
+	res := newTx(db, p, tx)
+	res.done = done
+	return res, nil
 }
 
-func (db *DB) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
-	v, ok := db.stmts.Load(query)
-	if ok {
-		// Statement already prepared and cached.
-		return v.(*sql.Stmt), nil
+// WithTx runs fn in a transaction which is committed if fn returns nil and
+// rolled back if it returns an error or panics. If the transaction fails with
+// an error recognized by [WithRetryable] the whole of it, fn included, is
+// retried with exponential backoff up to opts.Retries times.
+//
+// fn is given a context carrying the transaction, see [WithTxContext], so
+// that the queries it runs through the DB run in the transaction too.
+func (db *DB) WithTx(ctx context.Context, opts *TxOptions, fn func(ctx context.Context, tx *Tx) error) error {
+	var retries int
+	if opts != nil {
+		retries = opts.Retries
+	}
+
+	backoff := txRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := db.withTx(ctx, opts, fn)
+		if err == nil || attempt == retries || !db.isRetryable(err) {
+			return err
+		}
+
+		// Full jitter, so that conflicting transactions don't retry in
+		// lockstep.
+		t := time.NewTimer(time.Duration(rand.Int64N(int64(backoff)) + 1))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		backoff = min(2*backoff, txRetryMaxBackoff)
 	}
+}
 
-	// Statement not yet prepared.
-	stmt, err := db.db.PrepareContext(ctx, query)
+const (
+	txRetryBackoff    = 10 * time.Millisecond
+	txRetryMaxBackoff = time.Second
+)
+
+func (db *DB) withTx(ctx context.Context, opts *TxOptions, fn func(context.Context, *Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, opts)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(WithTxContext(ctx, tx), tx); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Close closes all cached statements and the underlying *sql.DB, replicas
+// included.
+func (db *DB) Close() error {
+	db.stop()
+
+	errs := []error{db.primary.close()}
+	for _, p := range db.replicas {
+		errs = append(errs, p.close())
+	}
+	return errors.Join(errs...)
+}
+
+// StmtCacheStats returns counters of the prepared statement caches, summed
+// over the primary and the replicas.
+func (db *DB) StmtCacheStats() StmtCacheStats {
+	res := db.primary.stmts.stats()
+	for _, p := range db.replicas {
+		s := p.stmts.stats()
+		res.Size += s.Size
+		res.Hits += s.Hits
+		res.Misses += s.Misses
+		res.Evictions += s.Evictions
+	}
+	return res
+}
+
+// stmt implements stmts, preparing query in the transaction carried by ctx,
+// if it was begun on db, see [WithTxContext].
+func (db *DB) stmt(ctx context.Context, query string) (*stmt, error) {
+	if tx := db.txFrom(ctx); tx != nil {
+		return tx.stmt(ctx, query)
+	}
+	return db.primary.stmt(ctx, query)
+}
+
+// ErrShutdown is returned when beginning a transaction, or pinging, once
+// [DB.Shutdown] has been called.
+var ErrShutdown = errors.New("dbs: database is shutting down")
+
+// txStarted counts a transaction in flight, which ends by calling done.
+func (db *DB) txStarted() (done func(), err error) {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+
+	if db.shutdown {
+		return nil, ErrShutdown
 	}
+	db.txs++
 
-	res, loaded := db.stmts.LoadOrStore(query, stmt)
-	if loaded {
-		// Another goroutine managed to LoadOrStore first, close statement
-		// and use loaded value.
-		if err := stmt.Close(); err != nil {
-			return nil, err
+	return sync.OnceFunc(func() {
+		db.txMu.Lock()
+		defer db.txMu.Unlock()
+
+		db.txs--
+		if db.shutdown && db.txs == 0 {
+			close(db.drained)
 		}
+	}), nil
+}
+
+// Shutdown stops new transactions from beginning, waits for those in flight
+// to commit or roll back and then closes the DB, as [DB.Close] does. If ctx
+// is done first, it returns its error and leaves the DB open, for Close to be
+// called regardless.
+func (db *DB) Shutdown(ctx context.Context) error {
+	db.txMu.Lock()
+	if !db.shutdown {
+		db.shutdown = true
+		db.drained = make(chan struct{})
+		if db.txs == 0 {
+			close(db.drained)
+		}
+	}
+	drained := db.drained
+	db.txMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-drained:
+		return db.Close()
+	}
+}
+
+// Ping checks that the primary database is reachable, for readiness probes.
+// It fails once [DB.Shutdown] has been called. Replicas aren't pinged, reads
+// fall back to the primary without them.
+func (db *DB) Ping(ctx context.Context) error {
+	db.txMu.Lock()
+	shutdown := db.shutdown
+	db.txMu.Unlock()
+	if shutdown {
+		return ErrShutdown
+	}
+
+	return db.primary.db.PingContext(ctx)
+}
+
+// Stats are statistics of a [DB].
+type Stats struct {
+	// Primary and Replicas are the connection pool statistics of the
+	// primary and each replica.
+	Primary  sql.DBStats
+	Replicas []sql.DBStats
+
+	// StmtCache is as returned by [DB.StmtCacheStats].
+	StmtCache StmtCacheStats
+
+	// InFlightTxs is the number of transactions begun and not yet ended.
+	InFlightTxs int
+}
+
+func (db *DB) Stats() Stats {
+	res := Stats{
+		Primary:   db.primary.db.Stats(),
+		StmtCache: db.StmtCacheStats(),
+	}
+	for _, p := range db.replicas {
+		res.Replicas = append(res.Replicas, p.db.Stats())
 	}
 
-	return res.(*sql.Stmt), nil
+	db.txMu.Lock()
+	res.InFlightTxs = db.txs
+	db.txMu.Unlock()
+
+	return res
 }
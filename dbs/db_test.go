@@ -1,13 +1,24 @@
 package dbs_test
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ek-os/dbs"
 
-	_ "github.com/mattn/go-sqlite3" // import sqlite3 driver
+	"github.com/mattn/go-sqlite3"
 )
 
 func TestDBS(t *testing.T) {
@@ -20,7 +31,8 @@ func TestDBS(t *testing.T) {
 		CREATE TABLE users (
 			id INTEGER PRIMARY KEY,
 			first_name TEXT NOT NULL,
-			last_name TEXT NOT NULL
+			last_name TEXT NOT NULL,
+			version INTEGER NOT NULL DEFAULT 1
 		);`); err != nil {
 		t.Fatalf("failed to create users table: %s", err)
 	}
@@ -67,3 +79,1613 @@ func TestDBS(t *testing.T) {
 		t.Fatalf("failed to commit tx: %s", err)
 	}
 }
+
+func TestGeneratedQueries(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	for _, name := range [][2]string{{"foo", "bar"}, {"baz", "bar"}, {"qux", "quux"}} {
+		if _, err := db.SaveUser(ctx, name[0], name[1]); err != nil {
+			t.Fatalf("failed to save user: %s", err)
+		}
+	}
+
+	users, err := db.FindUsersByLastName(ctx, "bar")
+	if err != nil {
+		t.Fatalf("failed to find users: %s", err)
+	}
+	if len(users) != 2 || users[0].FirstName != "foo" || users[1].FirstName != "baz" {
+		t.Errorf("unexpected users: %+v", users)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+
+	n, err := tx.DeleteUser(ctx, users[0].ID)
+	if err != nil {
+		tx.Rollback()
+		t.Fatalf("failed to delete user: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 deleted user, got %d", n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit tx: %s", err)
+	}
+
+	count, err := db.CountUsers(ctx)
+	if err != nil {
+		t.Fatalf("failed to count users: %s", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 users, got %d", count)
+	}
+}
+
+func TestQueryHelpers(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	for _, name := range [][2]string{{"foo", "bar"}, {"baz", "bar"}, {"qux", "quux"}} {
+		if _, err := db.SaveUser(ctx, name[0], name[1]); err != nil {
+			t.Fatalf("failed to save user: %s", err)
+		}
+	}
+
+	type name struct {
+		First   string `db:"first_name"`
+		Last    string `db:"last_name"`
+		Ignored string `db:"-"`
+	}
+	type user struct {
+		ID int64 // Matched case-insensitively.
+		name
+	}
+
+	t.Run("QueryOne", func(t *testing.T) {
+		got, err := dbs.QueryOne[user](ctx, db, "SELECT id, first_name, last_name FROM users WHERE id = @id", sql.Named("id", 2))
+		if err != nil {
+			t.Fatalf("failed to query user: %s", err)
+		}
+		if want := (user{2, name{First: "baz", Last: "bar"}}); got != want {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+
+		if _, err := dbs.QueryOne[user](ctx, db, "SELECT id FROM users WHERE id = 42"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected %v, got %v", sql.ErrNoRows, err)
+		}
+
+		n, err := dbs.QueryOne[int64](ctx, db, "SELECT count(*) FROM users")
+		if err != nil || n != 3 {
+			t.Errorf("expected 3 users, got %d (%v)", n, err)
+		}
+
+		if _, err := dbs.QueryOne[user](ctx, db, "SELECT id, 1 AS unknown FROM users"); err == nil {
+			t.Errorf("expected error scanning column without field")
+		}
+	})
+
+	t.Run("QueryAll", func(t *testing.T) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to begin tx: %s", err)
+		}
+		defer tx.Rollback()
+
+		got, err := dbs.QueryAll[name](ctx, tx, "SELECT first_name, last_name FROM users WHERE last_name = @last_name ORDER BY id", sql.Named("last_name", "bar"))
+		if err != nil {
+			t.Fatalf("failed to query users: %s", err)
+		}
+		want := []name{{First: "foo", Last: "bar"}, {First: "baz", Last: "bar"}}
+		if !slices.Equal(got, want) {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("QueryIter", func(t *testing.T) {
+		var got []string
+		for first, err := range dbs.QueryIter[string](ctx, db, "SELECT first_name FROM users ORDER BY id") {
+			if err != nil {
+				t.Fatalf("failed to query users: %s", err)
+			}
+			got = append(got, first)
+			if len(got) == 2 {
+				break
+			}
+		}
+		if want := []string{"foo", "baz"}; !slices.Equal(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+
+		// Breaking out of the loop closed the rows, so the statement is
+		// reusable.
+		if _, err := db.FindUser(ctx, 1); err != nil {
+			t.Errorf("failed to find user: %s", err)
+		}
+	})
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared&_foreign_keys=1", url.PathEscape(t.Name()))
+	sqldb, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqldb.Close() })
+
+	for _, query := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY, first_name TEXT NOT NULL, last_name TEXT NOT NULL, version INTEGER NOT NULL DEFAULT 1)`,
+		`CREATE UNIQUE INDEX users_name ON users (first_name, last_name)`,
+		`CREATE TABLE pets (
+			id INTEGER PRIMARY KEY,
+			owner_id INTEGER NOT NULL REFERENCES users (id),
+			name TEXT NOT NULL CONSTRAINT pets_name_not_empty CHECK (name <> '')
+		)`,
+	} {
+		if _, err := sqldb.Exec(query); err != nil {
+			t.Fatalf("failed to create schema: %s", err)
+		}
+	}
+
+	db := dbs.New(sqldb)
+	id, err := db.SaveUser(ctx, "foo", "bar")
+	if err != nil {
+		t.Fatalf("failed to save user: %s", err)
+	}
+
+	savePet := func(ownerID int64, name string) error {
+		_, err := dbs.QueryOne[int64](ctx, db, "INSERT INTO pets (owner_id, name) VALUES (@owner_id, @name) RETURNING id",
+			sql.Named("owner_id", ownerID), sql.Named("name", name))
+		return err
+	}
+
+	for _, tt := range []struct {
+		name       string
+		err        error
+		want       error
+		constraint string
+	}{
+		{
+			name: "not found",
+			err:  func() error { _, err := db.FindUser(ctx, 42); return err }(),
+			want: dbs.ErrNotFound,
+		},
+		{
+			name:       "unique",
+			err:        func() error { _, err := db.SaveUser(ctx, "foo", "bar"); return err }(),
+			want:       dbs.ErrUniqueViolation,
+			constraint: "users.first_name, users.last_name",
+		},
+		{
+			name: "foreign key",
+			err:  savePet(42, "rex"),
+			want: dbs.ErrForeignKeyViolation,
+		},
+		{
+			name:       "check",
+			err:        savePet(id, ""),
+			want:       dbs.ErrCheckViolation,
+			constraint: "pets_name_not_empty",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, tt.err)
+			}
+
+			var cerr *dbs.ConstraintError
+			if errors.As(tt.err, &cerr) && cerr.Constraint != tt.constraint {
+				t.Errorf("expected constraint %q, got %q", tt.constraint, cerr.Constraint)
+			}
+		})
+	}
+
+	// The original errors are still there.
+	if _, err := db.FindUser(ctx, 42); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected %v, got %v", sql.ErrNoRows, err)
+	}
+	var serr sqlite3.Error
+	if _, err := db.SaveUser(ctx, "foo", "bar"); !errors.As(err, &serr) {
+		t.Errorf("expected sqlite3.Error, got %T", err)
+	}
+
+	// Driver errors are found however they're wrapped.
+	wrapped := errors.Join(errors.New("foo"), fmt.Errorf("bar: %w", sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintUnique}))
+	if err := dbs.SQLite3Errors(wrapped); !errors.Is(err, dbs.ErrUniqueViolation) {
+		t.Errorf("expected %v, got %v", dbs.ErrUniqueViolation, err)
+	}
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy, ExtendedCode: sqlite3.ErrBusyRecovery}
+	if err := dbs.SQLite3Errors(busy); err != error(busy) {
+		t.Errorf("expected %v unchanged, got %v", busy, err)
+	}
+}
+
+type postgresError struct {
+	Code           string
+	ConstraintName string
+}
+
+func (e *postgresError) Error() string    { return "postgres error " + e.Code }
+func (e *postgresError) SQLState() string { return e.Code }
+
+func TestPostgresErrors(t *testing.T) {
+	err := dbs.PostgresErrors(fmt.Errorf("save user: %w", &postgresError{Code: "23505", ConstraintName: "users_email_key"}))
+
+	var cerr *dbs.ConstraintError
+	if !errors.Is(err, dbs.ErrUniqueViolation) || !errors.As(err, &cerr) {
+		t.Fatalf("expected %v, got %v", dbs.ErrUniqueViolation, err)
+	}
+	if cerr.Constraint != "users_email_key" {
+		t.Errorf("expected constraint users_email_key, got %q", cerr.Constraint)
+	}
+
+	serialization := &postgresError{Code: "40001"}
+	if err := dbs.PostgresErrors(serialization); err != serialization {
+		t.Errorf("expected error to be returned unchanged, got %v", err)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	id, err := db.SaveUser(ctx, "foo", "bar")
+	if err != nil {
+		t.Fatalf("failed to save user: %s", err)
+	}
+
+	// Two concurrent edits of the same version of the user.
+	first, err := db.FindUser(ctx, id)
+	if err != nil {
+		t.Fatalf("failed to find user: %s", err)
+	}
+	second := *first
+
+	first.FirstName = "baz"
+	if err := db.UpdateUser(ctx, first); err != nil {
+		t.Fatalf("failed to update user: %s", err)
+	}
+	if first.Version != 2 {
+		t.Errorf("expected version 2 after update, got %d", first.Version)
+	}
+
+	second.LastName = "qux"
+	if err := db.UpdateUser(ctx, &second); !errors.Is(err, dbs.ErrStaleVersion) {
+		t.Fatalf("expected %v, got %v", dbs.ErrStaleVersion, err)
+	}
+	if second.Version != 1 {
+		t.Errorf("expected version to stay 1 after failed update, got %d", second.Version)
+	}
+
+	got, err := db.FindUser(ctx, id)
+	if err != nil {
+		t.Fatalf("failed to find user: %s", err)
+	}
+	if *got != *first {
+		t.Errorf("expected %+v, got %+v", *first, *got)
+	}
+
+	// Updating again from the latest version succeeds.
+	got.LastName = "qux"
+	if err := db.UpdateUser(ctx, got); err != nil {
+		t.Fatalf("failed to update user: %s", err)
+	}
+
+	if err := dbs.UpdateVersioned(ctx, db, "users", "first_name = 'x'", "", 3); err == nil {
+		t.Errorf("expected error for update without WHERE clause")
+	}
+
+	// The WHERE clause is taken as it is, subqueries included.
+	if err := dbs.UpdateVersioned(ctx, db, "users", "first_name = 'x'", "id = (SELECT id FROM users WHERE last_name = @last_name) OR id = @id", 3,
+		sql.Named("last_name", "qux"), sql.Named("id", 42)); err != nil {
+		t.Fatalf("failed to update user: %s", err)
+	}
+	if err := dbs.UpdateVersioned(ctx, db, "users", "first_name = 'y'", "id = @id OR id = @id", 3, sql.Named("id", id)); !errors.Is(err, dbs.ErrStaleVersion) {
+		t.Errorf("expected %v, got %v", dbs.ErrStaleVersion, err)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	for _, name := range [][2]string{{"a", "x"}, {"b", "y"}, {"c", "x"}, {"d", "y"}, {"e", "x"}} {
+		if _, err := db.SaveUser(ctx, name[0], name[1]); err != nil {
+			t.Fatalf("failed to save user: %s", err)
+		}
+	}
+
+	t.Run("ListUsers", func(t *testing.T) {
+		var (
+			got    []string
+			cursor string
+			pages  int
+		)
+		for {
+			page, err := db.ListUsers(ctx, cursor, 2)
+			if err != nil {
+				t.Fatalf("failed to list users: %s", err)
+			}
+			pages++
+			for _, u := range page.Items {
+				got = append(got, u.FirstName)
+			}
+			if page.Next == "" {
+				break
+			}
+			cursor = page.Next
+		}
+
+		if want := []string{"a", "b", "c", "d", "e"}; !slices.Equal(got, want) || pages != 3 {
+			t.Errorf("expected %v in 3 pages, got %v in %d", want, got, pages)
+		}
+	})
+
+	t.Run("filtered by several columns", func(t *testing.T) {
+		type row struct {
+			LastName  string `db:"last_name"`
+			FirstName string `db:"first_name"`
+		}
+
+		var (
+			query   = "SELECT last_name, first_name FROM users"
+			filter  = "first_name <> @skip OR last_name = @keep"
+			orderBy = []string{"last_name", "first_name"}
+			args    = []any{sql.Named("skip", "c"), sql.Named("keep", "none")}
+		)
+		first, err := dbs.Paginate[row](ctx, db, query, filter, orderBy, "", 3, args...)
+		if err != nil {
+			t.Fatalf("failed to get first page: %s", err)
+		}
+		second, err := dbs.Paginate[row](ctx, db, query, filter, orderBy, first.Next, 3, args...)
+		if err != nil {
+			t.Fatalf("failed to get second page: %s", err)
+		}
+
+		want := []row{{"x", "a"}, {"x", "e"}, {"y", "b"}}
+		if !slices.Equal(first.Items, want) || first.Next == "" {
+			t.Errorf("expected first page %v with a next cursor, got %v (%q)", want, first.Items, first.Next)
+		}
+		want = []row{{"y", "d"}}
+		if !slices.Equal(second.Items, want) || second.Next != "" {
+			t.Errorf("expected last page %v, got %v (%q)", want, second.Items, second.Next)
+		}
+	})
+
+	if _, err := db.ListUsers(ctx, "garbage", 2); !errors.Is(err, dbs.ErrInvalidCursor) {
+		t.Errorf("expected %v, got %v", dbs.ErrInvalidCursor, err)
+	}
+
+	// Cursors of values that don't decode back are refused up front.
+	type nullable struct {
+		LastName sql.NullString `db:"last_name"`
+	}
+	if _, err := dbs.Paginate[nullable](ctx, db, "SELECT DISTINCT last_name FROM users", "", []string{"last_name"}, "", 1); err == nil {
+		t.Errorf("expected error paginating by a nullable column")
+	}
+}
+
+func TestDialect(t *testing.T) {
+	for name, dialect := range map[string]dbs.Dialect{
+		"sqlite":   dbs.DialectSQLite,
+		"postgres": dbs.DialectPostgres,
+		"mysql":    dbs.DialectMySQL,
+	} {
+		// SQLite also understands $1 and ? placeholders, so the rewritten
+		// queries run all the same.
+		t.Run(name, func(t *testing.T) {
+			var (
+				ctx = context.Background()
+				db  = newTestDB(t, dbs.WithDialect(dialect))
+			)
+
+			id, err := db.SaveUser(ctx, "foo", "bar")
+			if err != nil {
+				t.Fatalf("failed to save user: %s", err)
+			}
+			u, err := db.FindUser(ctx, id)
+			if err != nil {
+				t.Fatalf("failed to find user: %s", err)
+			}
+			u.FirstName = "baz"
+			if err := db.UpdateUser(ctx, u); err != nil {
+				t.Fatalf("failed to update user: %s", err)
+			}
+
+			if _, err := dbs.BulkInsert(ctx, db, "users", []string{"first_name", "last_name"}, func(yield func([]any) bool) {
+				yield([]any{"qux", "bar"})
+			}); err != nil {
+				t.Fatalf("failed to bulk insert: %s", err)
+			}
+			page, err := db.ListUsers(ctx, "", 1)
+			if err != nil {
+				t.Fatalf("failed to list users: %s", err)
+			}
+			page, err = db.ListUsers(ctx, page.Next, 1)
+			if err != nil || len(page.Items) != 1 || page.Items[0].FirstName != "qux" {
+				t.Fatalf("expected second page with qux, got %+v (%v)", page, err)
+			}
+
+			// Placeholders are only rewritten outside of literals and
+			// comments, and may repeat.
+			got, err := dbs.QueryOne[string](ctx, db, `SELECT '@a''s' || @name || "first_name" /* @b */ || @name -- @c
+				FROM users WHERE id = @id`, sql.Named("name", "!"), sql.Named("id", id))
+			if err != nil {
+				t.Fatalf("failed to query: %s", err)
+			}
+			if got != "@a's!baz!" {
+				t.Errorf("expected %q, got %q", "@a's!baz!", got)
+			}
+		})
+	}
+}
+
+func TestBulkInsert(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		execs int
+		db    = newTestDB(t,
+			// Two rows of three columns per statement.
+			dbs.WithMaxParams(7),
+			dbs.WithInterceptor(func(ctx context.Context, info *dbs.QueryInfo, next func(context.Context) error) error {
+				if info.Op == dbs.OpExec {
+					execs++
+				}
+				return next(ctx)
+			}),
+		)
+		columns = []string{"id", "first_name", "last_name"}
+	)
+
+	users := func(n int) iter.Seq[[]any] {
+		return func(yield func([]any) bool) {
+			for i := range n {
+				if !yield([]any{i + 1, fmt.Sprint("foo", i), "bar"}) {
+					return
+				}
+			}
+		}
+	}
+
+	n, err := dbs.BulkInsert(ctx, db, "users", columns, users(5))
+	if err != nil {
+		t.Fatalf("failed to bulk insert: %s", err)
+	}
+	if n != 5 || execs != 3 {
+		t.Errorf("expected 5 users inserted by 3 statements, got %d by %d", n, execs)
+	}
+	assertUserCount(t, db, 5)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+	if _, err := dbs.BulkInsert(ctx, tx, "users", columns[1:], func(yield func([]any) bool) {
+		yield([]any{"baz", "qux"})
+	}); err != nil {
+		tx.Rollback()
+		t.Fatalf("failed to bulk insert in tx: %s", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("failed to rollback tx: %s", err)
+	}
+	assertUserCount(t, db, 5)
+
+	// Through the queries of DB.Q, in and out of a transaction.
+	if _, err := dbs.BulkInsert(ctx, db.Q(ctx), "users", columns[1:], func(yield func([]any) bool) {
+		yield([]any{"baz", "qux"})
+	}); err != nil {
+		t.Fatalf("failed to bulk insert through queries: %s", err)
+	}
+	assertUserCount(t, db, 6)
+	err = db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+		if _, err := dbs.BulkInsert(ctx, db.Q(ctx), "users", columns[1:], func(yield func([]any) bool) {
+			yield([]any{"baz", "qux"})
+		}); err != nil {
+			return err
+		}
+		if n, err := dbs.QueryOne[int](ctx, tx, "SELECT count(*) FROM users"); err != nil || n != 7 {
+			t.Errorf("expected 7 users in tx, got %d (%v)", n, err)
+		}
+		return errors.New("abort")
+	})
+	if err == nil || err.Error() != "abort" {
+		t.Fatalf("expected tx to abort, got %v", err)
+	}
+	if _, err := dbs.BulkInsert(ctx, db.Replica(), "users", columns, users(1)); err == nil {
+		t.Errorf("expected bulk insert into a replica to fail")
+	}
+	assertUserCount(t, db, 6)
+
+	// A failing row fails the whole insert, including the rows already sent.
+	_, err = dbs.BulkInsert(ctx, db, "users", columns[1:], func(yield func([]any) bool) {
+		for range 3 {
+			if !yield([]any{"baz", "qux"}) {
+				return
+			}
+		}
+		yield([]any{"baz"})
+	})
+	if err == nil {
+		t.Fatalf("expected error inserting short row")
+	}
+	assertUserCount(t, db, 6)
+}
+
+func TestBulkInsertCopyIn(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		built   []string
+		queries []string
+	)
+
+	// The copy driver flushes on an exec without arguments, as lib/pq does.
+	openTestDB(t, t.Name())
+	sqldb, err := sql.Open("sqlite3-copy", fmt.Sprintf("file:%s?mode=memory&cache=shared", url.PathEscape(t.Name())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbs.New(sqldb,
+		dbs.WithCopyIn(func(table string, columns ...string) string {
+			built = append(built, table+" "+strings.Join(columns, ","))
+			return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (?, ?)"
+		}),
+		dbs.WithInterceptor(func(ctx context.Context, info *dbs.QueryInfo, next func(context.Context) error) error {
+			queries = append(queries, info.Op.String()+" "+info.Query)
+			return next(ctx)
+		}),
+	)
+	t.Cleanup(func() { db.Close() })
+
+	n, err := dbs.BulkInsert(ctx, db, "users", []string{"first_name", "last_name"}, func(yield func([]any) bool) {
+		for i := range 3 {
+			if !yield([]any{fmt.Sprint("foo", i), "bar"}) {
+				return
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to bulk insert: %s", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 users inserted, got %d", n)
+	}
+	if want := []string{"users first_name,last_name"}; !slices.Equal(built, want) {
+		t.Errorf("expected copy query built for %q, got %q", want, built)
+	}
+	if want := []string{"exec INSERT INTO users (first_name, last_name) VALUES (?, ?)"}; !slices.Equal(queries, want) {
+		t.Errorf("expected a single intercepted %q, got %q", want, queries)
+	}
+	assertUserCount(t, db, 3)
+}
+
+type testPublisher struct {
+	fail   bool
+	events []dbs.Event
+}
+
+func (p *testPublisher) Publish(ctx context.Context, e dbs.Event) error {
+	if p.fail {
+		p.fail = false
+		return errors.New("broker unavailable")
+	}
+	p.events = append(p.events, e)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	sqldb := openTestDB(t, t.Name())
+	if _, err := sqldb.Exec(dbs.OutboxSchema); err != nil {
+		t.Fatalf("failed to create outbox table: %s", err)
+	}
+	db := dbs.New(sqldb)
+
+	if err := db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+		if _, err := tx.SaveUser(ctx, "foo", "bar"); err != nil {
+			return err
+		}
+		return tx.Publish(ctx, "user.saved", []byte("foo bar"))
+	}); err != nil {
+		t.Fatalf("failed to save user: %s", err)
+	}
+
+	// Events of rolled back transactions are never delivered.
+	if err := db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+		if err := tx.Publish(ctx, "user.saved", []byte("baz qux")); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	}); err == nil {
+		t.Fatalf("expected transaction to fail")
+	}
+
+	var (
+		pub   = &testPublisher{fail: true}
+		relay = dbs.NewRelay(db, pub)
+	)
+	for i, want := range []struct {
+		n   int
+		err bool
+	}{
+		{0, true},  // The publisher fails, the event stays in the outbox.
+		{1, false}, // The event is delivered.
+		{0, false}, // Nothing is left to deliver.
+	} {
+		n, err := relay.Flush(ctx)
+		if n != want.n || (err != nil) != want.err {
+			t.Errorf("flush %d: expected %d events delivered and error %t, got %d and %v", i, want.n, want.err, n, err)
+		}
+	}
+
+	if len(pub.events) != 1 {
+		t.Fatalf("expected 1 event published, got %d", len(pub.events))
+	}
+	if e := pub.events[0]; e.Topic != "user.saved" || string(e.Payload) != "foo bar" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	for _, want := range []struct {
+		before time.Time
+		n      int64
+	}{
+		{time.Now().Add(-time.Hour), 0},
+		{time.Now().Add(time.Second), 1},
+	} {
+		if n, err := relay.Cleanup(ctx, want.before); err != nil || n != want.n {
+			t.Errorf("expected %d events cleaned up before %s, got %d (%v)", want.n, want.before, n, err)
+		}
+	}
+
+	// Run copes with a zero interval and batch size.
+	relay.Interval, relay.BatchSize = 0, 0
+	runCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := relay.Run(runCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		errFoo = errors.New("foo")
+	)
+
+	t.Run("commits", func(t *testing.T) {
+		db := newTestDB(t)
+
+		err := db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+			_, err := tx.SaveUser(ctx, "foo", "bar")
+			return err
+		})
+		if err != nil {
+			t.Fatalf("failed to run tx: %s", err)
+		}
+
+		assertUserCount(t, db, 1)
+	})
+
+	t.Run("rolls back on error", func(t *testing.T) {
+		db := newTestDB(t)
+
+		err := db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+			if _, err := tx.SaveUser(ctx, "foo", "bar"); err != nil {
+				return err
+			}
+			return errFoo
+		})
+		if !errors.Is(err, errFoo) {
+			t.Fatalf("expected %v, got %v", errFoo, err)
+		}
+
+		assertUserCount(t, db, 0)
+	})
+
+	t.Run("rolls back on panic", func(t *testing.T) {
+		db := newTestDB(t)
+
+		defer func() {
+			if p := recover(); p != "foo" {
+				t.Errorf("expected panic to be propagated, got %v", p)
+			}
+			assertUserCount(t, db, 0)
+		}()
+
+		db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+			if _, err := tx.SaveUser(ctx, "foo", "bar"); err != nil {
+				return err
+			}
+			panic("foo")
+		})
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		db := newTestDB(t, dbs.WithRetryable(func(err error) bool {
+			return errors.Is(err, errFoo)
+		}))
+
+		attempts := 0
+		err := db.WithTx(ctx, &dbs.TxOptions{Retries: 3}, func(ctx context.Context, tx *dbs.Tx) error {
+			attempts++
+			if _, err := tx.SaveUser(ctx, "foo", "bar"); err != nil {
+				return err
+			}
+			if attempts < 3 {
+				return errFoo
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to run tx: %s", err)
+		}
+		if attempts != 3 {
+			t.Errorf("expected 3 attempts, got %d", attempts)
+		}
+
+		assertUserCount(t, db, 1)
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		db := newTestDB(t, dbs.WithRetryable(func(err error) bool {
+			return errors.Is(err, errFoo)
+		}))
+
+		attempts := 0
+		err := db.WithTx(ctx, &dbs.TxOptions{Retries: 2}, func(ctx context.Context, tx *dbs.Tx) error {
+			attempts++
+			return errFoo
+		})
+		if !errors.Is(err, errFoo) {
+			t.Fatalf("expected %v, got %v", errFoo, err)
+		}
+		if attempts != 3 {
+			t.Errorf("expected 3 attempts, got %d", attempts)
+		}
+	})
+}
+
+func TestSavepoint(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	err := db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+		if _, err := tx.SaveUser(ctx, "foo", "bar"); err != nil {
+			return err
+		}
+
+		sp, err := tx.Savepoint(ctx, "rolled_back")
+		if err != nil {
+			return err
+		}
+		if _, err := sp.SaveUser(ctx, "baz", "qux"); err != nil {
+			return err
+		}
+		if n, err := dbs.QueryOne[int](ctx, sp, "SELECT count(*) FROM users"); err != nil || n != 2 {
+			t.Errorf("expected 2 users in savepoint, got %d (%v)", n, err)
+		}
+		if err := sp.Rollback(ctx); err != nil {
+			return err
+		}
+		if err := sp.Release(ctx); !errors.Is(err, dbs.ErrSavepointDone) {
+			t.Errorf("expected %v, got %v", dbs.ErrSavepointDone, err)
+		}
+
+		sp, err = tx.Savepoint(ctx, "released")
+		if err != nil {
+			return err
+		}
+		if _, err := tx.SaveUser(ctx, "quux", "corge"); err != nil {
+			return err
+		}
+		return sp.Release(ctx)
+	})
+	if err != nil {
+		t.Fatalf("failed to run tx: %s", err)
+	}
+
+	for lastName, want := range map[string]int{"bar": 1, "qux": 0, "corge": 1} {
+		users, err := db.FindUsersByLastName(ctx, lastName)
+		if err != nil {
+			t.Fatalf("failed to find users: %s", err)
+		}
+		if len(users) != want {
+			t.Errorf("expected %d users with last name %q, got %d", want, lastName, len(users))
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Savepoint(ctx, "x; DROP TABLE users"); err == nil {
+		t.Errorf("expected invalid savepoint name to be rejected")
+	}
+}
+
+func TestNestedSavepoints(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	err := db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+		outer, err := tx.Savepoint(ctx, "sp")
+		if err != nil {
+			return err
+		}
+		if _, err := outer.SaveUser(ctx, "foo", "bar"); err != nil {
+			return err
+		}
+
+		// The same name nested in itself.
+		inner, err := outer.Savepoint(ctx, "sp")
+		if err != nil {
+			return err
+		}
+		if _, err := inner.SaveUser(ctx, "baz", "qux"); err != nil {
+			return err
+		}
+		if err := inner.Rollback(ctx); err != nil {
+			return err
+		}
+
+		inner, err = outer.Savepoint(ctx, "sp")
+		if err != nil {
+			return err
+		}
+		if _, err := inner.SaveUser(ctx, "quux", "corge"); err != nil {
+			return err
+		}
+		// Releasing the outer savepoint releases the inner one too.
+		if err := outer.Release(ctx); err != nil {
+			return err
+		}
+		if err := inner.Release(ctx); !errors.Is(err, dbs.ErrSavepointDone) {
+			t.Errorf("expected %v, got %v", dbs.ErrSavepointDone, err)
+		}
+		if _, err := inner.Savepoint(ctx, "sp"); !errors.Is(err, dbs.ErrSavepointDone) {
+			t.Errorf("expected %v, got %v", dbs.ErrSavepointDone, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to run tx: %s", err)
+	}
+
+	for lastName, want := range map[string]int{"bar": 1, "qux": 0, "corge": 1} {
+		users, err := db.FindUsersByLastName(ctx, lastName)
+		if err != nil {
+			t.Fatalf("failed to find users: %s", err)
+		}
+		if len(users) != want {
+			t.Errorf("expected %d users with last name %q, got %d", want, lastName, len(users))
+		}
+	}
+}
+
+func TestTxCallbacks(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		logs bytes.Buffer
+		db   = newTestDB(t, dbs.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	)
+
+	var calls []string
+	record := func(call string) func() {
+		return func() { calls = append(calls, call) }
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		calls = nil
+
+		err := db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+			tx.OnCommit(record("commit 1"))
+			tx.OnRollback(record("rollback"))
+			tx.OnCommit(func() { panic("boom") })
+
+			sp, err := tx.Savepoint(ctx, "sp")
+			if err != nil {
+				return err
+			}
+			tx.OnCommit(record("rolled back to savepoint"))
+			if err := sp.Rollback(ctx); err != nil {
+				return err
+			}
+
+			tx.OnCommit(record("commit 2"))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to run tx: %s", err)
+		}
+
+		if want := []string{"commit 1", "commit 2"}; !slices.Equal(calls, want) {
+			t.Errorf("expected calls %v, got %v", want, calls)
+		}
+		if !strings.Contains(logs.String(), "panic=boom") {
+			t.Errorf("expected panic to be logged, got %q", logs.String())
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		calls = nil
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to begin tx: %s", err)
+		}
+		tx.OnCommit(record("commit"))
+		tx.OnRollback(record("rollback 1"))
+		tx.OnRollback(record("rollback 2"))
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("failed to rollback tx: %s", err)
+		}
+		// Callbacks only run once.
+		if err := tx.Rollback(); !errors.Is(err, sql.ErrTxDone) {
+			t.Errorf("expected %v, got %v", sql.ErrTxDone, err)
+		}
+
+		if want := []string{"rollback 1", "rollback 2"}; !slices.Equal(calls, want) {
+			t.Errorf("expected calls %v, got %v", want, calls)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		calls = nil
+
+		txCtx, cancel := context.WithCancel(ctx)
+		tx, err := db.BeginTx(txCtx, nil)
+		if err != nil {
+			t.Fatalf("failed to begin tx: %s", err)
+		}
+		tx.OnCommit(record("commit"))
+		tx.OnRollback(record("rollback"))
+		cancel()
+		waitRolledBack(t, tx)
+
+		if err := tx.Commit(); !errors.Is(err, sql.ErrTxDone) {
+			t.Errorf("expected %v, got %v", sql.ErrTxDone, err)
+		}
+		if err := tx.Rollback(); !errors.Is(err, sql.ErrTxDone) {
+			t.Errorf("expected %v, got %v", sql.ErrTxDone, err)
+		}
+
+		if want := []string{"rollback"}; !slices.Equal(calls, want) {
+			t.Errorf("expected calls %v, got %v", want, calls)
+		}
+	})
+}
+
+func TestTxContext(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	// A repository function that doesn't know whether it runs in a
+	// transaction.
+	saveUser := func(ctx context.Context) error {
+		_, err := db.Q(ctx).SaveUser(ctx, "foo", "bar")
+		return err
+	}
+
+	if err := saveUser(ctx); err != nil {
+		t.Fatalf("failed to save user: %s", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+	if err := saveUser(dbs.WithTxContext(ctx, tx)); err != nil {
+		tx.Rollback()
+		t.Fatalf("failed to save user in tx: %s", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("failed to rollback tx: %s", err)
+	}
+	assertUserCount(t, db, 1)
+
+	// WithTx passes the tx along, to the helpers too.
+	if err := db.WithTx(ctx, nil, func(ctx context.Context, tx *dbs.Tx) error {
+		if err := saveUser(ctx); err != nil {
+			return err
+		}
+		if n, err := dbs.QueryOne[int](ctx, db, "SELECT count(*) FROM users"); err != nil || n != 2 {
+			t.Errorf("expected 2 users in tx, got %d (%v)", n, err)
+		}
+		if _, err := dbs.BulkInsert(ctx, db, "users", []string{"first_name", "last_name"}, func(yield func([]any) bool) {
+			yield([]any{"baz", "qux"})
+		}); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	}); err == nil {
+		t.Fatalf("expected tx to fail")
+	}
+	assertUserCount(t, db, 1)
+
+	// A tx of another DB is ignored.
+	other := dbs.New(openTestDB(t, t.Name()+"/other"))
+	tx, err = other.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+	defer tx.Rollback()
+	if err := saveUser(dbs.WithTxContext(ctx, tx)); err != nil {
+		t.Fatalf("failed to save user: %s", err)
+	}
+	assertUserCount(t, db, 2)
+}
+
+func TestTxStmtsClosedAfterCommit(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+
+	for range 3 {
+		if _, err := tx.SaveUser(ctx, "foo", "bar"); err != nil {
+			tx.Rollback()
+			t.Fatalf("failed to save user: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit tx: %s", err)
+	}
+
+	if _, err := tx.SaveUser(ctx, "foo", "bar"); !errors.Is(err, sql.ErrTxDone) {
+		t.Errorf("expected %v, got %v", sql.ErrTxDone, err)
+	}
+
+	assertUserCount(t, db, 3)
+}
+
+func TestStmtCache(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t, dbs.WithStmtCacheSize(2))
+	)
+
+	id, err := db.SaveUser(ctx, "foo", "bar")
+	if err != nil {
+		t.Fatalf("failed to save user: %s", err)
+	}
+
+	for _, query := range []func() error{
+		func() error { _, err := db.FindUser(ctx, id); return err },
+		func() error { _, err := db.FindUser(ctx, id); return err },
+		func() error { _, err := db.CountUsers(ctx); return err },
+		// SaveUser was evicted to make room for CountUsers.
+		func() error { _, err := db.SaveUser(ctx, "baz", "qux"); return err },
+	} {
+		if err := query(); err != nil {
+			t.Fatalf("failed to run query: %s", err)
+		}
+	}
+
+	want := dbs.StmtCacheStats{Size: 2, Hits: 1, Misses: 4, Evictions: 2}
+	if got := db.StmtCacheStats(); got != want {
+		t.Errorf("unexpected stats\nwant: %+v\ngot:  %+v", want, got)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close db: %s", err)
+	}
+	if got := db.StmtCacheStats().Size; got != 0 {
+		t.Errorf("expected empty cache after close, got %d statements", got)
+	}
+	if _, err := db.FindUser(ctx, id); err == nil {
+		t.Errorf("expected query on closed db to fail")
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		primary = openTestDB(t, t.Name()+"/primary")
+		replica = openTestDB(t, t.Name()+"/replica")
+		db      = dbs.New(primary,
+			dbs.WithReplicas(replica),
+			dbs.WithHealthCheckInterval(10*time.Millisecond),
+		)
+	)
+	t.Cleanup(func() { db.Close() })
+
+	// Nothing replicates, so where a query ran shows in what it sees.
+	if _, err := replica.Exec(`INSERT INTO users (first_name, last_name) VALUES ('foo', 'bar')`); err != nil {
+		t.Fatalf("failed to insert user in replica: %s", err)
+	}
+
+	for range 2 {
+		if _, err := db.SaveUser(ctx, "baz", "qux"); err != nil {
+			t.Fatalf("failed to save user: %s", err)
+		}
+	}
+
+	// Queries go to the primary unless run through Replica.
+	assertUserCount(t, db, 2)
+	if got, err := db.Replica().CountUsers(ctx); err != nil || got != 1 {
+		t.Errorf("expected 1 user in replica, got %d (%v)", got, err)
+	}
+	if got, err := dbs.QueryOne[int](ctx, db.Replica(), "SELECT count(*) FROM users"); err != nil || got != 1 {
+		t.Errorf("expected 1 user in replica, got %d (%v)", got, err)
+	}
+	if got, err := dbs.QueryOne[int](ctx, db, "WITH n AS (SELECT count(*) FROM users) SELECT * FROM n"); err != nil || got != 2 {
+		t.Errorf("expected 2 users in primary, got %d (%v)", got, err)
+	}
+
+	var n int
+	if err := primary.QueryRow(`SELECT count(*) FROM users`).Scan(&n); err != nil {
+		t.Fatalf("failed to count users in primary: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 users in primary, got %d", n)
+	}
+
+	tx, err := db.BeginTx(ctx, &dbs.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to begin read-only tx: %s", err)
+	}
+	if got, err := tx.CountUsers(ctx); err != nil || got != 1 {
+		t.Errorf("expected 1 user in read-only tx, got %d (%v)", got, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("failed to rollback tx: %s", err)
+	}
+
+	// Reads fall back to the primary once the replica is unhealthy.
+	if err := replica.Close(); err != nil {
+		t.Fatalf("failed to close replica: %s", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, err := db.Replica().CountUsers(ctx)
+		if err == nil && got == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reads didn't fall back to the primary, got %d (%v)", got, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t, dbs.WithMaxOpenConns(4), dbs.WithConnMaxIdleTime(time.Minute))
+	)
+
+	if err := db.Ping(ctx); err != nil {
+		t.Fatalf("failed to ping: %s", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+
+	stats := db.Stats()
+	if stats.Primary.MaxOpenConnections != 4 || stats.InFlightTxs != 1 {
+		t.Errorf("expected 4 max open connections and 1 tx in flight, got %+v", stats)
+	}
+
+	// The transaction in flight keeps the DB open.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := db.Shutdown(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if _, err := db.BeginTx(ctx, nil); !errors.Is(err, dbs.ErrShutdown) {
+		t.Errorf("expected %v beginning tx, got %v", dbs.ErrShutdown, err)
+	}
+	if err := db.Ping(ctx); !errors.Is(err, dbs.ErrShutdown) {
+		t.Errorf("expected %v pinging, got %v", dbs.ErrShutdown, err)
+	}
+
+	shutdown := make(chan error)
+	go func() { shutdown <- db.Shutdown(ctx) }()
+
+	if _, err := tx.SaveUser(ctx, "foo", "bar"); err != nil {
+		t.Fatalf("failed to save user in tx: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit tx: %s", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("failed to shut down: %s", err)
+	}
+	if _, err := db.CountUsers(ctx); err == nil {
+		t.Errorf("expected query after shutdown to fail")
+	}
+}
+
+func TestShutdownAfterCancelledTx(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t)
+	)
+
+	txCtx, cancel := context.WithCancel(ctx)
+	tx, err := db.BeginTx(txCtx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+	cancel()
+	waitRolledBack(t, tx)
+
+	if err := tx.Rollback(); !errors.Is(err, sql.ErrTxDone) {
+		t.Errorf("expected %v, got %v", sql.ErrTxDone, err)
+	}
+	if n := db.Stats().InFlightTxs; n != 0 {
+		t.Errorf("expected no tx in flight, got %d", n)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := db.Shutdown(timeoutCtx); err != nil {
+		t.Fatalf("failed to shut down: %s", err)
+	}
+}
+
+// waitRolledBack waits for the database/sql package to roll back tx after
+// its context is done.
+func waitRolledBack(t *testing.T, tx *dbs.Tx) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for i := 0; ; i++ {
+		// A new statement each time, those prepared before are closed along
+		// with the tx.
+		if _, err := dbs.QueryOne[int](context.Background(), tx, fmt.Sprint("SELECT ", i)); errors.Is(err, sql.ErrTxDone) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tx wasn't rolled back after its context was done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		infos  []dbs.QueryInfo
+		logs   bytes.Buffer
+		hist   = dbs.NewLatencyHistogram()
+		record = func(ctx context.Context, info *dbs.QueryInfo, next func(context.Context) error) error {
+			err := next(ctx)
+			infos = append(infos, *info)
+			return err
+		}
+		db = newTestDB(t,
+			dbs.WithInterceptor(record),
+			dbs.WithInterceptor(dbs.SlogInterceptor(slog.New(slog.NewTextHandler(&logs, nil)), slog.LevelInfo)),
+			dbs.WithInterceptor(hist.Interceptor),
+			dbs.WithRedactedArgs("last_name"),
+		)
+	)
+
+	id, err := db.SaveUser(ctx, "foo", "bar")
+	if err != nil {
+		t.Fatalf("failed to save user: %s", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+	if _, err := tx.FindUser(ctx, id); err != nil {
+		tx.Rollback()
+		t.Fatalf("failed to find user: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit tx: %s", err)
+	}
+
+	const (
+		save = "INSERT INTO users (first_name, last_name) VALUES (@first_name, @last_name)"
+		find = "SELECT id, first_name, last_name, version FROM users WHERE id = @id"
+	)
+	want := []struct {
+		op           dbs.Op
+		query        string
+		args         []sql.NamedArg
+		rowsAffected int64
+	}{
+		{dbs.OpPrepare, save, []sql.NamedArg{}, -1},
+		{dbs.OpExec, save, []sql.NamedArg{sql.Named("first_name", "foo"), sql.Named("last_name", dbs.Redacted)}, 1},
+		{dbs.OpPrepare, find, []sql.NamedArg{}, -1},
+		{dbs.OpQuery, find, []sql.NamedArg{sql.Named("id", id)}, -1},
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("expected %d intercepted operations, got %d: %+v", len(want), len(infos), infos)
+	}
+	for i, w := range want {
+		got := infos[i]
+		if got.Op != w.op || got.Query != w.query || got.RowsAffected != w.rowsAffected ||
+			fmt.Sprint(got.Args) != fmt.Sprint(w.args) || got.Duration <= 0 || got.Err != nil {
+			t.Errorf("operation %d doesn't match\nwant: %+v\ngot:  %+v", i, w, got)
+		}
+	}
+
+	if !strings.Contains(logs.String(), "op=exec query=\"INSERT INTO users (first_name, last_name) VALUES (@first_name, @last_name)\"") ||
+		!strings.Contains(logs.String(), "args.last_name=[REDACTED] rows_affected=1") {
+		t.Errorf("unexpected logs:\n%s", logs.String())
+	}
+
+	snapshot := hist.Snapshot()
+	if snapshot[save].Total != 1 || snapshot[find].Total != 1 {
+		t.Errorf("expected one execution of each query to be recorded, got %+v", snapshot)
+	}
+}
+
+func TestInterceptorMustCallNext(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newTestDB(t, dbs.WithInterceptor(func(ctx context.Context, info *dbs.QueryInfo, next func(context.Context) error) error {
+			if info.Op == dbs.OpPrepare {
+				return next(ctx)
+			}
+			return nil
+		}))
+	)
+
+	if _, err := db.SaveUser(ctx, "foo", "bar"); !errors.Is(err, dbs.ErrNextNotCalled) {
+		t.Errorf("expected %v, got %v", dbs.ErrNextNotCalled, err)
+	}
+	if _, err := db.CountUsers(ctx); !errors.Is(err, dbs.ErrNextNotCalled) {
+		t.Errorf("expected %v, got %v", dbs.ErrNextNotCalled, err)
+	}
+}
+
+func TestLatencyHistogramMaxQueries(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		hist = dbs.NewLatencyHistogram()
+		db   = newTestDB(t, dbs.WithInterceptor(hist.Interceptor))
+	)
+	hist.MaxQueries = 2
+
+	for _, query := range []string{
+		"SELECT 1",
+		"SELECT\n\t1",
+		"SELECT 2",
+		"SELECT 3",
+		"SELECT 4",
+	} {
+		if _, err := dbs.QueryOne[int](ctx, db, query); err != nil {
+			t.Fatalf("failed to run %q: %s", query, err)
+		}
+	}
+
+	snapshot := hist.Snapshot()
+	if len(snapshot) != 3 || snapshot["SELECT 1"].Total != 2 || snapshot["SELECT 2"].Total != 1 || snapshot[dbs.OtherQueries].Total != 2 {
+		t.Errorf("unexpected histograms %+v", snapshot)
+	}
+}
+
+// BenchmarkTxRepeatedQuery runs the same query many times in each
+// transaction. The statement is prepared on the transaction once, costing one
+// prepare per transaction, instead of one per call.
+func BenchmarkTxRepeatedQuery(b *testing.B) {
+	ctx := context.Background()
+
+	sqldb, err := sql.Open("sqlite3-counting", "file:bench-tx?mode=memory&cache=shared")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sqldb.Close()
+
+	// Hold on to a connection so the database outlives the others, which
+	// are closed as soon as they're idle. Every transaction thus runs on a
+	// fresh connection, where the statements prepared on the DB don't exist.
+	conn, err := sqldb.Conn(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	sqldb.SetMaxIdleConns(0)
+
+	// The counting driver runs only the first statement of a multi statement
+	// query, as it goes through Prepare.
+	for _, query := range []string{
+		`CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			first_name TEXT NOT NULL,
+			last_name TEXT NOT NULL,
+			version INTEGER NOT NULL DEFAULT 1
+		)`,
+		`INSERT INTO users (id, first_name, last_name) VALUES (1, 'foo', 'bar')`,
+	} {
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			b.Fatalf("failed to set up users table: %s", err)
+		}
+	}
+
+	db := dbs.New(sqldb)
+	prepares.Store(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			b.Fatalf("failed to begin tx: %s", err)
+		}
+
+		for range 100 {
+			if _, err := tx.FindUser(ctx, 1); err != nil {
+				tx.Rollback()
+				b.Fatalf("failed to find user: %s", err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			b.Fatalf("failed to commit tx: %s", err)
+		}
+	}
+
+	b.ReportMetric(float64(prepares.Load())/float64(b.N), "prepares/op")
+}
+
+// prepares counts the statements prepared through the sqlite3-counting driver.
+var prepares atomic.Int64
+
+func init() {
+	sql.Register("sqlite3-counting", countingDriver{&sqlite3.SQLiteDriver{}})
+}
+
+type countingDriver struct {
+	driver.Driver
+}
+
+func (d countingDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{c.(countedConn)}, nil
+}
+
+type countedConn interface {
+	driver.Conn
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+}
+
+type countingConn struct {
+	countedConn
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	prepares.Add(1)
+	return c.countedConn.Prepare(query)
+}
+
+func (c countingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	prepares.Add(1)
+	return c.countedConn.PrepareContext(ctx, query)
+}
+
+func init() {
+	sql.Register("sqlite3-copy", copyDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// copyDriver mimics the COPY support of lib/pq, where statements take any
+// number of arguments and executing one without arguments flushes the rows.
+type copyDriver struct {
+	driver.Driver
+}
+
+func (d copyDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return copyConn{c.(countedConn)}, nil
+}
+
+type copyConn struct {
+	countedConn
+}
+
+func (c copyConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	s, err := c.countedConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return copyStmt{s}, nil
+}
+
+type copyStmt struct {
+	driver.Stmt
+}
+
+func (s copyStmt) NumInput() int { return -1 }
+
+func (s copyStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if len(args) == 0 {
+		return driver.RowsAffected(0), nil
+	}
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s copyStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+}
+
+// newTestDB returns a DB with an empty users table. Every connection to
+// :memory: is a separate database, so the test gets its own shared cache
+// database instead, where statements prepared outside of a transaction see
+// the same tables as the transaction.
+func newTestDB(t *testing.T, opts ...dbs.Option) *dbs.DB {
+	t.Helper()
+	return dbs.New(openTestDB(t, t.Name()), opts...)
+}
+
+// openTestDB opens an in-memory database with a users table, shared by all
+// connections of the pool.
+func openTestDB(t *testing.T, name string) *sql.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", url.PathEscape(name))
+	sqldb, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqldb.Close() })
+
+	if _, err := sqldb.Exec(`
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			first_name TEXT NOT NULL,
+			last_name TEXT NOT NULL,
+			version INTEGER NOT NULL DEFAULT 1
+		);`); err != nil {
+		t.Fatalf("failed to create users table: %s", err)
+	}
+
+	return sqldb
+}
+
+func assertUserCount(t *testing.T, db *dbs.DB, want int64) {
+	t.Helper()
+
+	got, err := db.CountUsers(context.Background())
+	if err != nil {
+		t.Fatalf("failed to count users: %s", err)
+	}
+	if got != want {
+		t.Errorf("expected %d users, got %d", want, got)
+	}
+}
@@ -0,0 +1,114 @@
+package dbs
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ek-os/dbs/internal/lex"
+)
+
+// Dialect is the placeholder style of a driver. Queries are written with
+// @name placeholders and [sql.Named] arguments, which are rewritten to the
+// dialect's style when a query is prepared.
+type Dialect int
+
+const (
+	// DialectSQLite keeps @name placeholders, which go-sqlite3 supports.
+	DialectSQLite Dialect = iota
+
+	// DialectPostgres numbers placeholders, $1, $2, the same name getting
+	// the same number, as lib/pq and pgx expect.
+	DialectPostgres
+
+	// DialectMySQL replaces every placeholder with ?.
+	DialectMySQL
+)
+
+// WithDialect sets the placeholder style queries are rewritten to,
+// [DialectSQLite] by default, which leaves them as they are.
+func WithDialect(d Dialect) Option {
+	return func(db *DB) {
+		db.hooks.dialect = d
+	}
+}
+
+// placeholders is a query rewritten for a dialect.
+type placeholders struct {
+	query string
+
+	// params are the names of the arguments in positional order, nil if
+	// arguments are passed as they are.
+	params []string
+}
+
+// placeholders returns query rewritten for the dialect. Rewritten queries
+// aren't cached here but along with the statements prepared from them, so
+// that they are bounded the same way.
+func (h *hooks) placeholders(query string) *placeholders {
+	if h == nil || h.dialect == DialectSQLite {
+		return &placeholders{query: query}
+	}
+	return rewrite(query, h.dialect)
+}
+
+// rewrite replaces the @name placeholders of query, which [lex.Placeholders]
+// finds outside of string literals, quoted identifiers and comments.
+func rewrite(query string, d Dialect) *placeholders {
+	var (
+		b      strings.Builder
+		params []string
+		number = map[string]int{}
+		last   int
+	)
+
+	for _, p := range lex.Placeholders(query, lex.Dialect(d)) {
+		b.WriteString(query[last:p.Start])
+		last = p.End
+
+		switch d {
+		case DialectPostgres:
+			n, ok := number[p.Name]
+			if !ok {
+				params = append(params, p.Name)
+				n = len(params)
+				number[p.Name] = n
+			}
+			b.WriteString("$" + strconv.Itoa(n))
+		case DialectMySQL:
+			params = append(params, p.Name)
+			b.WriteByte('?')
+		}
+	}
+	b.WriteString(query[last:])
+
+	return &placeholders{query: b.String(), params: params}
+}
+
+// bind turns the named arguments of a query into positional ones in the order
+// of params.
+func bind(params []string, args []any) ([]any, error) {
+	if params == nil {
+		return args, nil
+	}
+
+	named := make(map[string]any, len(args))
+	for _, arg := range args {
+		na, ok := arg.(sql.NamedArg)
+		if !ok || na.Name == "" {
+			return nil, fmt.Errorf("query with @name placeholders needs sql.Named arguments, got %T", arg)
+		}
+		named[na.Name] = na.Value
+	}
+
+	res := make([]any, len(params))
+	for i, name := range params {
+		v, ok := named[name]
+		if !ok {
+			return nil, fmt.Errorf("missing argument @%s", name)
+		}
+		res[i] = v
+	}
+	return res, nil
+}
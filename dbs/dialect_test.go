@@ -0,0 +1,94 @@
+package dbs
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		dialect Dialect
+		query   string
+		want    string
+		params  []string
+	}{
+		{
+			name:    "postgres numbers names",
+			dialect: DialectPostgres,
+			query:   "SELECT * FROM users WHERE first_name = @name OR last_name = @name AND id > @id",
+			want:    "SELECT * FROM users WHERE first_name = $1 OR last_name = $1 AND id > $2",
+			params:  []string{"name", "id"},
+		},
+		{
+			name:    "mysql repeats names",
+			dialect: DialectMySQL,
+			query:   "SELECT * FROM users WHERE first_name = @name OR last_name = @name AND id > @id",
+			want:    "SELECT * FROM users WHERE first_name = ? OR last_name = ? AND id > ?",
+			params:  []string{"name", "name", "id"},
+		},
+		{
+			name:    "quotes and comments",
+			dialect: DialectPostgres,
+			query:   "SELECT '@a', 'it''s @b', \"@c\" -- @d\n, @e /* @f */",
+			want:    "SELECT '@a', 'it''s @b', \"@c\" -- @d\n, $1 /* @f */",
+			params:  []string{"e"},
+		},
+		{
+			name:    "mysql backslash escapes",
+			dialect: DialectMySQL,
+			query:   `SELECT 'it\'s @a', "say \"@b\"", @c, 'C:\\', @d`,
+			want:    `SELECT 'it\'s @a', "say \"@b\"", ?, 'C:\\', ?`,
+			params:  []string{"c", "d"},
+		},
+		{
+			name:    "mysql variables",
+			dialect: DialectMySQL,
+			query:   "SELECT @@version, @a",
+			want:    "SELECT @@version, ?",
+			params:  []string{"a"},
+		},
+		{
+			name:    "postgres standard strings keep backslashes",
+			dialect: DialectPostgres,
+			query:   `SELECT 'C:\', @a`,
+			want:    `SELECT 'C:\', $1`,
+			params:  []string{"a"},
+		},
+		{
+			name:    "postgres escape strings",
+			dialect: DialectPostgres,
+			query:   `SELECT E'it\'s @a', e'@b', @c`,
+			want:    `SELECT E'it\'s @a', e'@b', $1`,
+			params:  []string{"c"},
+		},
+		{
+			name:    "postgres dollar quotes",
+			dialect: DialectPostgres,
+			query:   "SELECT $$it's @a$$, $fn$ @b $$ @c $fn$, @d",
+			want:    "SELECT $$it's @a$$, $fn$ @b $$ @c $fn$, $1",
+			params:  []string{"d"},
+		},
+		{
+			name:    "postgres positional parameters",
+			dialect: DialectPostgres,
+			query:   "SELECT $1, a$b, @c",
+			want:    "SELECT $1, a$b, $1",
+			params:  []string{"c"},
+		},
+		{
+			name:    "unterminated",
+			dialect: DialectPostgres,
+			query:   "SELECT @a, $x$ @b",
+			want:    "SELECT $1, $x$ @b",
+			params:  []string{"a"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rewrite(tt.query, tt.dialect)
+			if got.query != tt.want || !slices.Equal(got.params, tt.params) {
+				t.Errorf("expected %q with params %q, got %q with %q", tt.want, tt.params, got.query, got.params)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package dbs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned instead of [sql.ErrNoRows], which it still
+	// matches with errors.Is.
+	ErrNotFound = errors.New("dbs: not found")
+
+	ErrUniqueViolation     = errors.New("dbs: unique violation")
+	ErrForeignKeyViolation = errors.New("dbs: foreign key violation")
+	ErrCheckViolation      = errors.New("dbs: check violation")
+)
+
+// ConstraintError is a violation of a database constraint. It matches its
+// Kind, one of [ErrUniqueViolation], [ErrForeignKeyViolation] or
+// [ErrCheckViolation], and the driver error with errors.Is and errors.As.
+type ConstraintError struct {
+	Kind error
+
+	// Constraint is what the driver reports of the violated constraint,
+	// its name for Postgres and e.g. the table and columns for SQLite.
+	// Empty if not reported.
+	Constraint string
+
+	Err error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Constraint == "" {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s on %s: %s", e.Kind, e.Constraint, e.Err)
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorTranslator turns the errors of a driver into the errors of this
+// package, and returns errors it doesn't recognize unchanged.
+type ErrorTranslator func(err error) error
+
+// WithErrorTranslators sets the translators applied, in order, to the errors
+// of every query and commit, [SQLite3Errors] and [PostgresErrors] by
+// default. [sql.ErrNoRows] is turned into [ErrNotFound] regardless.
+func WithErrorTranslators(translators ...ErrorTranslator) Option {
+	return func(db *DB) {
+		db.hooks.translators = translators
+	}
+}
+
+// errNoRows is what [sql.ErrNoRows] is translated to.
+var errNoRows = fmt.Errorf("%w: %w", ErrNotFound, sql.ErrNoRows)
+
+var defaultTranslators = []ErrorTranslator{SQLite3Errors, PostgresErrors}
+
+// translate applies the translators to err.
+func (h *hooks) translate(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) && !errors.Is(err, ErrNotFound) {
+		return errNoRows
+	}
+	if h == nil {
+		return err
+	}
+
+	for _, translate := range h.translators {
+		err = translate(err)
+	}
+	return err
+}
+
+// SQLite3Errors translates the constraint errors of
+// github.com/mattn/go-sqlite3, by their extended result codes.
+func SQLite3Errors(err error) error {
+	serr, code := sqlite3Error(err)
+	if serr == nil || errors.As(err, new(*ConstraintError)) {
+		return err
+	}
+
+	var kind error
+	switch code {
+	case 2067, 1555: // SQLITE_CONSTRAINT_UNIQUE, SQLITE_CONSTRAINT_PRIMARYKEY
+		kind = ErrUniqueViolation
+	case 787: // SQLITE_CONSTRAINT_FOREIGNKEY
+		kind = ErrForeignKeyViolation
+	case 275: // SQLITE_CONSTRAINT_CHECK
+		kind = ErrCheckViolation
+	default:
+		return err
+	}
+
+	// E.g. "UNIQUE constraint failed: users.email".
+	_, constraint, _ := strings.Cut(serr.Error(), "constraint failed: ")
+	return &ConstraintError{Kind: kind, Constraint: constraint, Err: err}
+}
+
+// sqlite3Error finds a github.com/mattn/go-sqlite3 error in the tree of err
+// and returns it with its extended result code, without depending on the
+// driver, which needs cgo.
+func sqlite3Error(err error) (error, int64) {
+	for errs := []error{err}; len(errs) > 0; {
+		err, errs = errs[len(errs)-1], errs[:len(errs)-1]
+
+		v := reflect.Indirect(reflect.ValueOf(err))
+		if v.IsValid() && v.Type().PkgPath() == "github.com/mattn/go-sqlite3" && v.Type().Name() == "Error" {
+			if f := v.FieldByName("ExtendedCode"); f.IsValid() && f.CanInt() {
+				return err, f.Int()
+			}
+		}
+
+		switch u := err.(type) {
+		case interface{ Unwrap() error }:
+			if err := u.Unwrap(); err != nil {
+				errs = append(errs, err)
+			}
+		case interface{ Unwrap() []error }:
+			errs = append(errs, u.Unwrap()...)
+		}
+	}
+	return nil, 0
+}
+
+// PostgresErrors translates constraint errors by their SQLSTATE, as reported
+// by the SQLState method of the errors of Postgres drivers. The constraint
+// name is taken from their ConstraintName or Constraint field.
+func PostgresErrors(err error) error {
+	var perr interface{ SQLState() string }
+	if !errors.As(err, &perr) || errors.As(err, new(*ConstraintError)) {
+		return err
+	}
+
+	var kind error
+	switch perr.SQLState() {
+	case "23505":
+		kind = ErrUniqueViolation
+	case "23503":
+		kind = ErrForeignKeyViolation
+	case "23514":
+		kind = ErrCheckViolation
+	default:
+		return err
+	}
+
+	return &ConstraintError{Kind: kind, Constraint: constraintName(perr), Err: err}
+}
+
+// constraintName reads the constraint name off a Postgres driver error,
+// without depending on the driver.
+func constraintName(err any) string {
+	v := reflect.Indirect(reflect.ValueOf(err))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	for _, name := range []string{"ConstraintName", "Constraint"} {
+		if f := v.FieldByName(name); f.IsValid() && f.Kind() == reflect.String {
+			return f.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,296 @@
+package dbs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNextNotCalled is returned for an operation that an interceptor returned
+// from without error but without calling next, so that it didn't run.
+var ErrNextNotCalled = errors.New("dbs: interceptor did not call next")
+
+// Interceptor is called around every prepare and execution of a query, which
+// happens when it calls next. It must call next exactly once and return its
+// error, or return an error of its own without calling next, and may pass on
+// a different context, e.g. one carrying a span.
+// Once next returns, info also holds the outcome.
+type Interceptor func(ctx context.Context, info *QueryInfo, next func(context.Context) error) error
+
+// Op is the kind of operation being intercepted.
+type Op int
+
+const (
+	OpPrepare Op = iota
+	OpExec
+	OpQuery
+	OpQueryRow
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPrepare:
+		return "prepare"
+	case OpExec:
+		return "exec"
+	case OpQuery:
+		return "query"
+	case OpQueryRow:
+		return "query_row"
+	default:
+		return "unknown"
+	}
+}
+
+// QueryInfo describes an intercepted operation.
+type QueryInfo struct {
+	Op    Op
+	Query string
+
+	// Args are the query arguments, with the values of those named in
+	// [WithRedactedArgs] replaced. Positional arguments have no name.
+	Args []sql.NamedArg
+
+	// Set once next returns. RowsAffected is -1 unless known, which it only
+	// is for OpExec.
+	Duration     time.Duration
+	RowsAffected int64
+	Err          error
+}
+
+// Redacted replaces the values of arguments named in [WithRedactedArgs].
+const Redacted = "[REDACTED]"
+
+// WithInterceptor adds an interceptor around every prepare and execution of
+// a query. Interceptors run in the order they are added, the first one
+// outermost.
+func WithInterceptor(i Interceptor) Option {
+	return func(db *DB) {
+		db.hooks.interceptors = append(db.hooks.interceptors, i)
+	}
+}
+
+// WithRedactedArgs keeps the values of the named arguments, such as
+// passwords or personal data, from interceptors.
+func WithRedactedArgs(names ...string) Option {
+	return func(db *DB) {
+		db.hooks.redacted = append(db.hooks.redacted, names...)
+	}
+}
+
+type hooks struct {
+	interceptors []Interceptor
+	redacted     []string
+	translators  []ErrorTranslator
+	log          *slog.Logger
+
+	dialect Dialect
+}
+
+// WithLogger sets where problems that can't be returned, such as panics in
+// [Tx.OnCommit] callbacks, are logged, [slog.Default] by default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(db *DB) {
+		db.hooks.log = logger
+	}
+}
+
+func (h *hooks) logger() *slog.Logger {
+	if h == nil || h.log == nil {
+		return slog.Default()
+	}
+	return h.log
+}
+
+// run runs fn, the operation described by op, query and args, through the
+// interceptors. Its error is translated before the interceptors see it.
+func (h *hooks) run(ctx context.Context, op Op, query string, args []any, fn func(context.Context, *QueryInfo) error) error {
+	if h == nil || len(h.interceptors) == 0 {
+		return h.translate(fn(ctx, &QueryInfo{}))
+	}
+
+	info := &QueryInfo{
+		Op:           op,
+		Query:        query,
+		Args:         h.namedArgs(args),
+		RowsAffected: -1,
+	}
+
+	var called bool
+	next := func(ctx context.Context) error {
+		called = true
+		start := time.Now()
+		info.Err = h.translate(fn(ctx, info))
+		info.Duration = time.Since(start)
+		return info.Err
+	}
+	for _, i := range slices.Backward(h.interceptors) {
+		next = func(next func(context.Context) error) func(context.Context) error {
+			return func(ctx context.Context) error { return i(ctx, info, next) }
+		}(next)
+	}
+
+	if err := next(ctx); err != nil || called {
+		return err
+	}
+	return ErrNextNotCalled
+}
+
+func (h *hooks) namedArgs(args []any) []sql.NamedArg {
+	res := make([]sql.NamedArg, len(args))
+	for i, arg := range args {
+		na, ok := arg.(sql.NamedArg)
+		if !ok {
+			na = sql.NamedArg{Value: arg}
+		}
+		if na.Name != "" && slices.Contains(h.redacted, na.Name) {
+			na.Value = Redacted
+		}
+		res[i] = na
+	}
+	return res
+}
+
+// SlogInterceptor logs every operation to logger at level, and failed ones at
+// error level.
+func SlogInterceptor(logger *slog.Logger, level slog.Level) Interceptor {
+	return func(ctx context.Context, info *QueryInfo, next func(context.Context) error) error {
+		err := next(ctx)
+
+		attrs := []slog.Attr{
+			slog.String("op", info.Op.String()),
+			slog.String("query", info.Query),
+			slog.Duration("duration", info.Duration),
+		}
+		if len(info.Args) > 0 {
+			args := make([]any, len(info.Args))
+			for i, arg := range info.Args {
+				name := arg.Name
+				if name == "" {
+					name = "$" + strconv.Itoa(i+1)
+				}
+				args[i] = slog.Any(name, arg.Value)
+			}
+			attrs = append(attrs, slog.Group("args", args...))
+		}
+		if info.RowsAffected >= 0 {
+			attrs = append(attrs, slog.Int64("rows_affected", info.RowsAffected))
+		}
+
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "query failed", append(attrs, slog.Any("error", err))...)
+		} else {
+			logger.LogAttrs(ctx, level, "query", attrs...)
+		}
+		return err
+	}
+}
+
+// DefaultLatencyBuckets are the upper bounds used by [NewLatencyHistogram]
+// when none are given.
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// OtherQueries is the key of [LatencyHistogram.Snapshot] the queries past
+// MaxQueries are recorded under.
+const OtherQueries = "other"
+
+// LatencyHistogram records how long the executions of each query take.
+// Register it with WithInterceptor(h.Interceptor).
+type LatencyHistogram struct {
+	bounds []time.Duration
+
+	// MaxQueries is how many queries get a histogram of their own, 1000 by
+	// default, so that queries built on the fly don't grow it without bound.
+	// Further queries are recorded together under [OtherQueries].
+	MaxQueries int
+
+	mu      sync.Mutex
+	queries map[string]*Histogram
+}
+
+// Histogram is a snapshot of the latencies of a query. Counts[i] is the
+// number of executions that took at most Bounds[i], the last count is of the
+// ones that took longer than all bounds.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []int64
+	Total  int64
+	Sum    time.Duration
+}
+
+func NewLatencyHistogram(bounds ...time.Duration) *LatencyHistogram {
+	if len(bounds) == 0 {
+		bounds = DefaultLatencyBuckets
+	}
+	bounds = slices.Clone(bounds)
+	slices.Sort(bounds)
+
+	return &LatencyHistogram{
+		bounds:     bounds,
+		MaxQueries: 1000,
+		queries:    make(map[string]*Histogram),
+	}
+}
+
+// Interceptor implements Interceptor, recording every execution but not
+// prepares.
+func (h *LatencyHistogram) Interceptor(ctx context.Context, info *QueryInfo, next func(context.Context) error) error {
+	err := next(ctx)
+	if info.Op == OpPrepare {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Queries differing only in layout are the same.
+	query := strings.Join(strings.Fields(info.Query), " ")
+	hist, ok := h.queries[query]
+	if !ok && len(h.queries) >= h.MaxQueries {
+		query = OtherQueries
+		hist, ok = h.queries[query]
+	}
+	if !ok {
+		hist = &Histogram{Bounds: h.bounds, Counts: make([]int64, len(h.bounds)+1)}
+		h.queries[query] = hist
+	}
+
+	i, _ := slices.BinarySearch(h.bounds, info.Duration)
+	hist.Counts[i]++
+	hist.Total++
+	hist.Sum += info.Duration
+
+	return err
+}
+
+// Snapshot returns the histograms recorded so far by query, with whitespace
+// collapsed.
+func (h *LatencyHistogram) Snapshot() map[string]Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := make(map[string]Histogram, len(h.queries))
+	for query, hist := range h.queries {
+		res[query] = Histogram{
+			Bounds: hist.Bounds,
+			Counts: slices.Clone(hist.Counts),
+			Total:  hist.Total,
+			Sum:    hist.Sum,
+		}
+	}
+	return res
+}
@@ -0,0 +1,129 @@
+// Package lex finds the @name placeholders of queries, for dbs to rewrite
+// them and for dbs-gen to turn them into method parameters.
+package lex
+
+import "strings"
+
+// Dialect is the syntax queries are lexed with, in the order of dbs.Dialect.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+	MySQL
+)
+
+// Placeholder is an @name placeholder at query[Start:End].
+type Placeholder struct {
+	Name       string
+	Start, End int
+}
+
+// Placeholders returns the @name placeholders of query in order, skipping
+// string literals, quoted identifiers and comments. Backslashes escape quotes
+// in MySQL strings and in Postgres E'...' strings, and Postgres dollar-quoted
+// strings, $$...$$ or $tag$...$tag$, are skipped too.
+func Placeholders(query string, d Dialect) []Placeholder {
+	var found []Placeholder
+
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			backslash := d == MySQL && c != '`' ||
+				d == Postgres && c == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && (i == 1 || !isNameChar(query[i-2]))
+			i = quotedEnd(query, i, backslash)
+
+		case c == '$' && d == Postgres && (i == 0 || !isNameChar(query[i-1])):
+			end := i + 1
+			if tag := dollarTag(query[i:]); tag != "" {
+				if j := strings.Index(query[i+len(tag):], tag); j >= 0 {
+					end = i + len(tag) + j + len(tag)
+				} else {
+					end = len(query)
+				}
+			}
+			i = end
+
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			i += end
+
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i
+			} else {
+				end += 4
+			}
+			i += end
+
+		case c == '@' && i+1 < len(query) && isNameStart(query[i+1]):
+			end := i + 1
+			for end < len(query) && isNameChar(query[end]) {
+				end++
+			}
+			found = append(found, Placeholder{Name: query[i+1 : end], Start: i, End: end})
+			i = end
+
+		case c == '@':
+			// E.g. MySQL's @@variables.
+			for i < len(query) && query[i] == '@' {
+				i++
+			}
+
+		default:
+			i++
+		}
+	}
+
+	return found
+}
+
+// quotedEnd returns the end of the quoted string or identifier starting at
+// query[i], where a doubled quote is an escaped one, and so is a quote after a
+// backslash if backslash is set.
+func quotedEnd(query string, i int, backslash bool) int {
+	quote := query[i]
+	for end := i + 1; end < len(query); end++ {
+		switch query[end] {
+		case '\\':
+			if backslash {
+				end++
+			}
+		case quote:
+			if end+1 < len(query) && query[end+1] == quote {
+				end++
+				continue
+			}
+			return end + 1
+		}
+	}
+	return len(query)
+}
+
+// dollarTag returns the opening delimiter of the Postgres dollar-quoted string
+// query starts with, e.g. $$ or $fn$, or "" if it doesn't start with one, as
+// with a $1 parameter.
+func dollarTag(query string) string {
+	end := 1
+	if end < len(query) && isNameStart(query[end]) {
+		for end < len(query) && isNameChar(query[end]) {
+			end++
+		}
+	}
+	if end < len(query) && query[end] == '$' {
+		return query[:end+1]
+	}
+	return ""
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || '0' <= c && c <= '9'
+}
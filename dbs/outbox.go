@@ -0,0 +1,206 @@
+package dbs
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// OutboxSchema creates the table [Tx.Publish] records events in, for SQLite.
+// Elsewhere the table needs the same columns, with id generated on insert.
+const OutboxSchema = `
+CREATE TABLE IF NOT EXISTS dbs_outbox (
+	id INTEGER PRIMARY KEY,
+	topic TEXT NOT NULL,
+	payload BLOB NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	sent_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS dbs_outbox_unsent ON dbs_outbox (id) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS dbs_outbox_sent ON dbs_outbox (sent_at) WHERE sent_at IS NOT NULL;
+`
+
+// Event is an event recorded in the outbox.
+type Event struct {
+	ID        int64
+	Topic     string
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// Publish records an event in the outbox, to be delivered by a [Relay] once
+// and only if the transaction commits.
+func (tx *Tx) Publish(ctx context.Context, topic string, payload []byte) error {
+	stmt, err := tx.stmt(ctx, "INSERT INTO dbs_outbox (topic, payload, created_at) VALUES (@topic, @payload, @created_at)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx,
+		sql.Named("topic", topic),
+		sql.Named("payload", payload),
+		sql.Named("created_at", time.Now().UTC()),
+	)
+	return err
+}
+
+// Publisher delivers events, e.g. to a message broker.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Relay delivers the events recorded in the outbox to a [Publisher]. Delivery
+// is at least once: an event is marked sent after it is published, so a crash
+// in between, or relays running concurrently, deliver it again.
+//
+// Events are delivered by id, which is the order they were recorded in but
+// not necessarily the order their transactions committed in. An event whose
+// transaction commits after a later event was delivered is delivered next,
+// out of order but never skipped. Consumers needing a strict order must
+// restore it from the payloads, e.g. from a version of the entity.
+type Relay struct {
+	db  *DB
+	pub Publisher
+
+	// Interval is how often [Relay.Run] polls the outbox, a second by
+	// default.
+	Interval time.Duration
+
+	// BatchSize is how many events are read from the outbox at once, 100
+	// by default.
+	BatchSize int
+
+	// Retention is how long [Relay.Run] keeps sent events before deleting
+	// them, forever if zero.
+	Retention time.Duration
+
+	// OnError, if set, is called with the errors [Relay.Run] keeps going
+	// after.
+	OnError func(error)
+}
+
+func NewRelay(db *DB, pub Publisher) *Relay {
+	return &Relay{
+		db:        db,
+		pub:       pub,
+		Interval:  time.Second,
+		BatchSize: 100,
+	}
+}
+
+// Run delivers events every Interval until ctx is done, and deletes the ones
+// sent longer than Retention ago. A failed delivery is retried at the next
+// poll.
+func (r *Relay) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		// Drain the outbox before waiting for the next poll.
+		for {
+			n, err := r.Flush(ctx)
+			r.report(ctx, err)
+			if err != nil || n < r.batchSize() {
+				break
+			}
+		}
+
+		if r.Retention > 0 {
+			_, err := r.Cleanup(ctx, time.Now().Add(-r.Retention))
+			r.report(ctx, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Flush delivers a batch of unsent events and returns how many it delivered.
+// It stops at the first event that fails to publish, so that events are
+// delivered in order.
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	events, err := r.unsent(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, e := range events {
+		if err := r.pub.Publish(ctx, e); err != nil {
+			return i, err
+		}
+		if err := r.markSent(ctx, e.ID); err != nil {
+			return i, err
+		}
+	}
+
+	return len(events), nil
+}
+
+// Cleanup deletes the events sent before t and returns how many it deleted.
+func (r *Relay) Cleanup(ctx context.Context, t time.Time) (int64, error) {
+	stmt, err := r.db.stmt(ctx, "DELETE FROM dbs_outbox WHERE sent_at IS NOT NULL AND sent_at < @before")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.ExecContext(ctx, sql.Named("before", t.UTC()))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// report passes the errors of Run to OnError, unless Run is stopping.
+func (r *Relay) report(ctx context.Context, err error) {
+	if err != nil && ctx.Err() == nil && r.OnError != nil {
+		r.OnError(err)
+	}
+}
+
+func (r *Relay) batchSize() int {
+	if r.BatchSize <= 0 {
+		return 100
+	}
+	return r.BatchSize
+}
+
+func (r *Relay) unsent(ctx context.Context) ([]Event, error) {
+	stmt, err := r.db.stmt(ctx, "SELECT id, topic, payload, created_at FROM dbs_outbox WHERE sent_at IS NULL ORDER BY id LIMIT @limit")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.QueryContext(ctx, sql.Named("limit", r.batchSize()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.Topic, &e.Payload, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (r *Relay) markSent(ctx context.Context, id int64) error {
+	stmt, err := r.db.stmt(ctx, "UPDATE dbs_outbox SET sent_at = @sent_at WHERE id = @id")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, sql.Named("sent_at", time.Now().UTC()), sql.Named("id", id))
+	return err
+}
@@ -0,0 +1,157 @@
+package dbs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidCursor is returned by [Paginate] for a cursor it didn't return.
+var ErrInvalidCursor = errors.New("dbs: invalid cursor")
+
+// Page is a page of rows returned by [Paginate].
+type Page[T any] struct {
+	Items []T
+
+	// Next is the cursor of the next page, empty on the last one.
+	Next string
+}
+
+// Paginate returns the page of at most limit rows of query that follows
+// cursor, or the first page for an empty cursor. Rows are scanned into Ts as
+// by [QueryOne].
+//
+// query is a SELECT without WHERE, ORDER BY or LIMIT, and filter, if not
+// empty, the condition of its WHERE clause. Rows are ordered by the orderBy
+// columns, in ascending order, which together must be unique and selected
+// into fields of T. Pages are found by comparing those columns to the last
+// row of the previous page,
+//
+//	WHERE (filter) AND (a, b) > (@cursor_0, @cursor_1) ORDER BY a, b LIMIT @limit
+//
+// so that later pages cost the same as the first, unlike with OFFSET.
+// Cursors hold the values of the last row, which must be integers, floats or
+// strings. The ordering columns can't be NULL, such rows would be skipped.
+func Paginate[T any](ctx context.Context, q Querier, query, filter string, orderBy []string, cursor string, limit int, args ...any) (Page[T], error) {
+	if len(orderBy) == 0 || limit <= 0 {
+		return Page[T]{}, fmt.Errorf("paginate: need ordering columns and a positive limit, got %v and %d", orderBy, limit)
+	}
+
+	var where []string
+	if filter != "" {
+		where = append(where, "("+filter+")")
+	}
+	args = args[:len(args):len(args)]
+	if cursor != "" {
+		values, err := decodeCursor(cursor, len(orderBy))
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		params := make([]string, len(values))
+		for i, v := range values {
+			params[i] = "@cursor_" + strconv.Itoa(i)
+			args = append(args, sql.Named("cursor_"+strconv.Itoa(i), v))
+		}
+
+		where = append(where, "("+strings.Join(orderBy, ", ")+") > ("+strings.Join(params, ", ")+")")
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// One more row than the page tells whether there is a next one.
+	query += " ORDER BY " + strings.Join(orderBy, ", ") + " LIMIT @limit"
+	args = append(args, sql.Named("limit", limit+1))
+
+	items, err := QueryAll[T](ctx, q, query, args...)
+	if err != nil {
+		return Page[T]{}, err
+	}
+	if len(items) <= limit {
+		return Page[T]{Items: items}, nil
+	}
+
+	items = items[:limit]
+	next, err := encodeCursor(items[limit-1], orderBy)
+	if err != nil {
+		return Page[T]{}, err
+	}
+	return Page[T]{Items: items, Next: next}, nil
+}
+
+// encodeCursor encodes the values of the orderBy columns of v.
+func encodeCursor[T any](v T, orderBy []string) (string, error) {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Struct {
+		return "", fmt.Errorf("paginate: can't take cursor from %T, not a struct", v)
+	}
+
+	fields := structFields(val.Type())
+	values := make([]any, len(orderBy))
+	for i, col := range orderBy {
+		// Columns may be qualified, e.g. u.id.
+		if j := strings.LastIndexByte(col, '.'); j >= 0 {
+			col = col[j+1:]
+		}
+		index, ok := fields[strings.ToLower(col)]
+		if !ok {
+			return "", fmt.Errorf("paginate: no field of %T for ordering column %q", v, col)
+		}
+		f := val.FieldByIndex(index)
+		switch f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+			reflect.Float32, reflect.Float64, reflect.String:
+		default:
+			// Not decodable, or nullable such as sql.NullString.
+			return "", fmt.Errorf("paginate: ordering column %q is a %s, not an integer, float or string", col, f.Type())
+		}
+		values[i] = f.Interface()
+	}
+
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("paginate: encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(cursor string, n int) ([]any, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var values []any
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&values); err != nil || len(values) != n {
+		return nil, ErrInvalidCursor
+	}
+
+	for i, v := range values {
+		switch v := v.(type) {
+		case json.Number:
+			// Integers must stay integers, not become float64.
+			if n, err := v.Int64(); err == nil {
+				values[i] = n
+			} else if f, err := v.Float64(); err == nil {
+				values[i] = f
+			} else {
+				return nil, ErrInvalidCursor
+			}
+		case string:
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	return values, nil
+}
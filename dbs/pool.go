@@ -0,0 +1,159 @@
+package dbs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// pool is a *sql.DB with its own statement cache, since a *sql.Stmt can only
+// be used with the *sql.DB it was prepared on.
+type pool struct {
+	db      *sql.DB
+	stmts   *stmtCache
+	hooks   *hooks
+	healthy atomic.Bool
+}
+
+func newPool(db *sql.DB, stmtCacheSize int, hooks *hooks) *pool {
+	p := &pool{
+		db:    db,
+		stmts: newStmtCache(stmtCacheSize),
+		hooks: hooks,
+	}
+	p.healthy.Store(true)
+	return p
+}
+
+func (p *pool) stmt(ctx context.Context, query string) (*stmt, error) {
+	if s, ok := p.stmts.get(query); ok {
+		// Statement already prepared and cached.
+		s.query, s.hooks = query, p.hooks
+		return s, nil
+	}
+
+	// Statement not yet prepared.
+	var (
+		prepared *sql.Stmt
+		ph       = p.hooks.placeholders(query)
+	)
+	if err := p.hooks.run(ctx, OpPrepare, query, nil, func(ctx context.Context, _ *QueryInfo) (err error) {
+		prepared, err = p.db.PrepareContext(ctx, ph.query)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	s, err := p.stmts.add(query, prepared, ph.params)
+	if err != nil {
+		return nil, err
+	}
+	s.query, s.hooks = query, p.hooks
+	return s, nil
+}
+
+func (p *pool) close() error {
+	return errors.Join(p.stmts.close(), p.db.Close())
+}
+
+// DefaultHealthCheckInterval is how often replicas are pinged unless
+// configured otherwise with [WithHealthCheckInterval].
+const DefaultHealthCheckInterval = 5 * time.Second
+
+// WithReplicas routes the queries run through [DB.Replica] and read-only
+// transactions to the replicas in turn. Replicas failing their health check
+// are skipped until they pass it again, without a healthy replica reads go to
+// the primary. [DB.Close] closes the replicas too.
+func WithReplicas(replicas ...*sql.DB) Option {
+	return func(db *DB) {
+		db.replicaDBs = append(db.replicaDBs, replicas...)
+	}
+}
+
+// WithHealthCheckInterval sets how often replicas are pinged.
+func WithHealthCheckInterval(d time.Duration) Option {
+	return func(db *DB) {
+		db.healthCheckInterval = d
+	}
+}
+
+// Replica returns the queries run on a replica, for reads that can do with
+// data lagging behind the primary. They run on the primary without replicas.
+// Queries run through the [DB] itself always run on the primary.
+func (db *DB) Replica() *Queries {
+	return db.replica
+}
+
+// replica implements stmts on the replicas.
+type replica struct {
+	db *DB
+}
+
+func (r replica) stmt(ctx context.Context, query string) (*stmt, error) {
+	return r.db.readPool().stmt(ctx, query)
+}
+
+// readPool returns the next healthy replica, or the primary if there is none.
+func (db *DB) readPool() *pool {
+	n := uint64(len(db.replicas))
+	for range n {
+		p := db.replicas[db.nextReplica.Add(1)%n]
+		if p.healthy.Load() {
+			return p
+		}
+	}
+	return db.primary
+}
+
+func (db *DB) checkReplicas(ctx context.Context) {
+	t := time.NewTicker(db.healthCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for _, p := range db.replicas {
+			ctx, cancel := context.WithTimeout(ctx, db.healthCheckInterval)
+			p.healthy.Store(p.db.PingContext(ctx) == nil)
+			cancel()
+		}
+	}
+}
+
+// WithMaxOpenConns sets the most open connections of the primary and of each
+// replica, see [sql.DB.SetMaxOpenConns].
+func WithMaxOpenConns(n int) Option {
+	return func(db *DB) {
+		db.tuning = append(db.tuning, func(sqldb *sql.DB) { sqldb.SetMaxOpenConns(n) })
+	}
+}
+
+// WithMaxIdleConns sets the most idle connections of the primary and of each
+// replica, see [sql.DB.SetMaxIdleConns].
+func WithMaxIdleConns(n int) Option {
+	return func(db *DB) {
+		db.tuning = append(db.tuning, func(sqldb *sql.DB) { sqldb.SetMaxIdleConns(n) })
+	}
+}
+
+// WithConnMaxLifetime sets how long connections are reused at most, see
+// [sql.DB.SetConnMaxLifetime].
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(db *DB) {
+		db.tuning = append(db.tuning, func(sqldb *sql.DB) { sqldb.SetConnMaxLifetime(d) })
+	}
+}
+
+// WithConnMaxIdleTime sets how long connections stay idle at most, see
+// [sql.DB.SetConnMaxIdleTime].
+func WithConnMaxIdleTime(d time.Duration) Option {
+	return func(db *DB) {
+		db.tuning = append(db.tuning, func(sqldb *sql.DB) { sqldb.SetConnMaxIdleTime(d) })
+	}
+}
@@ -1,5 +1,7 @@
 package dbs
 
+//go:generate go run ./cmd/dbs-gen -schema schema.sql -o queries_gen.go queries.sql
+
 import (
 	"context"
 	"database/sql"
@@ -11,28 +13,27 @@ type Queries struct {
 }
 
 type stmts interface {
-	stmt(ctx context.Context, query string) (*sql.Stmt, error)
+	stmt(ctx context.Context, query string) (*stmt, error)
+}
+
+// stmt implements stmts, so that Queries are a [Querier] too.
+func (q *Queries) stmt(ctx context.Context, query string) (*stmt, error) {
+	return q.stmts.stmt(ctx, query)
 }
 
 type User struct {
-	ID        int64
-	FirstName string
-	LastName  string
+	ID        int64  `db:"id"`
+	FirstName string `db:"first_name"`
+	LastName  string `db:"last_name"`
+	Version   int64  `db:"version"`
 }
 
 func (q *Queries) FindUser(ctx context.Context, id int64) (*User, error) {
-	stmt, err := q.stmts.stmt(ctx, "SELECT first_name, last_name FROM users WHERE id = @id")
+	u, err := QueryOne[User](ctx, q.stmts, "SELECT id, first_name, last_name, version FROM users WHERE id = @id", sql.Named("id", id))
 	if err != nil {
 		return nil, err
 	}
-
-	u := &User{ID: id}
-	if err := stmt.QueryRowContext(ctx, sql.Named("id", id)).
-		Scan(&u.FirstName, &u.LastName); err != nil {
-		return nil, err
-	}
-
-	return u, nil
+	return &u, nil
 }
 
 func (q *Queries) SaveUser(ctx context.Context, firstName, lastName string) (int64, error) {
@@ -47,3 +48,21 @@ func (q *Queries) SaveUser(ctx context.Context, firstName, lastName string) (int
 	}
 	return res.LastInsertId()
 }
+
+// UpdateUser saves the names of u, unless the user was updated since u was
+// read, in which case it returns [ErrStaleVersion]. On success u is at the
+// new version.
+func (q *Queries) UpdateUser(ctx context.Context, u *User) error {
+	if err := UpdateVersioned(ctx, q.stmts, "users", "first_name = @first_name, last_name = @last_name", "id = @id", u.Version,
+		sql.Named("first_name", u.FirstName), sql.Named("last_name", u.LastName), sql.Named("id", u.ID)); err != nil {
+		return err
+	}
+
+	u.Version++
+	return nil
+}
+
+// ListUsers returns the page of users after cursor, by id.
+func (q *Queries) ListUsers(ctx context.Context, cursor string, limit int) (Page[User], error) {
+	return Paginate[User](ctx, q.stmts, "SELECT id, first_name, last_name, version FROM users", "", []string{"id"}, cursor, limit)
+}
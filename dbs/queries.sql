@@ -0,0 +1,12 @@
+-- name: CountUsers :one
+-- column: n int64
+SELECT count(*) AS n FROM users;
+
+-- name: FindUsersByLastName :many
+SELECT id, first_name, last_name
+FROM users
+WHERE last_name = @last_name
+ORDER BY id;
+
+-- name: DeleteUser :execrows
+DELETE FROM users WHERE id = @id;
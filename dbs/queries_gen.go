@@ -0,0 +1,69 @@
+// Code generated by dbs-gen. DO NOT EDIT.
+
+package dbs
+
+import (
+	"context"
+	"database/sql"
+)
+
+func (q *Queries) CountUsers(ctx context.Context) (int64, error) {
+	stmt, err := q.stmts.stmt(ctx, `SELECT count(*) AS n FROM users`)
+	if err != nil {
+		return 0, err
+	}
+
+	var r int64
+	if err := stmt.QueryRowContext(ctx).
+		Scan(&r); err != nil {
+		return 0, err
+	}
+
+	return r, nil
+}
+
+type FindUsersByLastNameRow struct {
+	ID        int64
+	FirstName string
+	LastName  string
+}
+
+func (q *Queries) FindUsersByLastName(ctx context.Context, lastName string) ([]FindUsersByLastNameRow, error) {
+	stmt, err := q.stmts.stmt(ctx, `SELECT id, first_name, last_name
+FROM users
+WHERE last_name = @last_name
+ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.QueryContext(ctx, sql.Named("last_name", lastName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []FindUsersByLastNameRow
+	for rows.Next() {
+		var r FindUsersByLastNameRow
+		if err := rows.Scan(&r.ID, &r.FirstName, &r.LastName); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+
+	return res, rows.Err()
+}
+
+func (q *Queries) DeleteUser(ctx context.Context, id int64) (int64, error) {
+	stmt, err := q.stmts.stmt(ctx, `DELETE FROM users WHERE id = @id`)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.ExecContext(ctx, sql.Named("id", id))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
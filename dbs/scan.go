@@ -0,0 +1,174 @@
+package dbs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"iter"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Querier runs queries, it is implemented by [*DB], [*Tx], [*Savepoint] and
+// [*Queries], such as those of [DB.Replica], so that [QueryOne], [QueryAll]
+// and [QueryIter] work the same in and out of a transaction.
+type Querier interface {
+	stmts
+}
+
+// QueryOne runs query and scans its first row into a T, returning
+// [ErrNotFound] if there is none.
+//
+// If T is a struct, columns are scanned into the fields of the same name,
+// which is the field's db tag if it has one, e.g. `db:"first_name"`, or else
+// the field name compared case-insensitively. Fields tagged `db:"-"` are
+// ignored and a column without a field is an error. Any other T is scanned
+// from a single column.
+func QueryOne[T any](ctx context.Context, q Querier, query string, args ...any) (T, error) {
+	for v, err := range QueryIter[T](ctx, q, query, args...) {
+		return v, err
+	}
+
+	var zero T
+	return zero, errNoRows
+}
+
+// QueryAll runs query and scans all of its rows into Ts, as [QueryOne] does.
+func QueryAll[T any](ctx context.Context, q Querier, query string, args ...any) ([]T, error) {
+	var res []T
+	for v, err := range QueryIter[T](ctx, q, query, args...) {
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// QueryIter runs query and yields its rows scanned into Ts, as [QueryOne]
+// does, without holding all of them in memory. An error ends the iteration
+// and is yielded with the zero T. The rows are closed when the loop ends, so
+// the connection is held until then.
+func QueryIter[T any](ctx context.Context, q Querier, query string, args ...any) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+
+		stmt, err := q.stmt(ctx, query)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+
+		rows, err := stmt.QueryContext(ctx, args...)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		defer rows.Close()
+
+		cols, err := rows.Columns()
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		scan, err := newScanner[T](cols)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+
+		for rows.Next() {
+			var v T
+			if err := rows.Scan(scan(&v)...); err != nil {
+				yield(zero, stmt.hooks.translate(err))
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield(zero, stmt.hooks.translate(err))
+		}
+	}
+}
+
+// newScanner returns a function returning the Scan destinations of the
+// columns in a T.
+func newScanner[T any](cols []string) (func(*T) []any, error) {
+	typ := reflect.TypeFor[T]()
+	if typ.Kind() != reflect.Struct || typ == timeType || reflect.PointerTo(typ).Implements(scannerType) {
+		if len(cols) != 1 {
+			return nil, fmt.Errorf("scan %d columns into %s: expected a single column", len(cols), typ)
+		}
+		return func(v *T) []any { return []any{v} }, nil
+	}
+
+	fields := structFields(typ)
+	indexes := make([][]int, len(cols))
+	for i, col := range cols {
+		index, ok := fields[strings.ToLower(col)]
+		if !ok {
+			return nil, fmt.Errorf("scan column %q into %s: no such field", col, typ)
+		}
+		indexes[i] = index
+	}
+
+	return func(v *T) []any {
+		s := reflect.ValueOf(v).Elem()
+		dest := make([]any, len(indexes))
+		for i, index := range indexes {
+			dest[i] = s.FieldByIndex(index).Addr().Interface()
+		}
+		return dest
+	}, nil
+}
+
+var (
+	scannerType = reflect.TypeFor[sql.Scanner]()
+	timeType    = reflect.TypeFor[time.Time]()
+)
+
+// fieldsCache maps struct types to the indexes of their fields by lowercased
+// column name.
+var fieldsCache sync.Map // of reflect.Type to map[string][]int
+
+func structFields(typ reflect.Type) map[string][]int {
+	if fields, ok := fieldsCache.Load(typ); ok {
+		return fields.(map[string][]int)
+	}
+
+	fields := map[string][]int{}
+	for _, f := range reflect.VisibleFields(typ) {
+		if !f.IsExported() || f.Anonymous && f.Type.Kind() == reflect.Struct || viaPointer(typ, f.Index) {
+			continue
+		}
+
+		name, ok := f.Tag.Lookup("db")
+		switch {
+		case name == "-":
+			continue
+		case !ok || name == "":
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Index
+	}
+
+	fieldsCache.Store(typ, fields)
+	return fields
+}
+
+// viaPointer reports whether the field at index is promoted through an
+// embedded pointer, which may be nil.
+func viaPointer(typ reflect.Type, index []int) bool {
+	for _, i := range index[:len(index)-1] {
+		typ = typ.Field(i).Type
+		if typ.Kind() == reflect.Pointer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,6 @@
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY,
+	first_name TEXT NOT NULL,
+	last_name TEXT NOT NULL,
+	version INTEGER NOT NULL DEFAULT 1
+);
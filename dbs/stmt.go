@@ -0,0 +1,259 @@
+package dbs
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// stmt is a prepared statement handed to a single query, which must run
+// exactly once. Running it gives the statement back, so that a statement
+// evicted from the cache meanwhile is only closed once nobody uses it.
+type stmt struct {
+	stmt    *sql.Stmt
+	release func()
+
+	query  string
+	params []string // See placeholders.
+	hooks  *hooks
+}
+
+func (s *stmt) done() {
+	if s.release != nil {
+		s.release()
+	}
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args ...any) (res sql.Result, err error) {
+	defer s.done()
+
+	err = s.hooks.run(ctx, OpExec, s.query, args, func(ctx context.Context, info *QueryInfo) error {
+		bound, err := bind(s.params, args)
+		if err != nil {
+			return err
+		}
+		res, err = s.stmt.ExecContext(ctx, bound...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			info.RowsAffected = n
+		}
+		return nil
+	})
+	return res, err
+}
+
+// QueryContext runs the query. The returned rows keep the statement open on
+// their own until they are closed.
+func (s *stmt) QueryContext(ctx context.Context, args ...any) (rows *sql.Rows, err error) {
+	defer s.done()
+
+	err = s.hooks.run(ctx, OpQuery, s.query, args, func(ctx context.Context, _ *QueryInfo) error {
+		bound, err := bind(s.params, args)
+		if err != nil {
+			return err
+		}
+		rows, err = s.stmt.QueryContext(ctx, bound...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRowContext runs the query. Interceptors see the error of running it,
+// but not the [ErrNotFound] only Scan reports.
+func (s *stmt) QueryRowContext(ctx context.Context, args ...any) *row {
+	defer s.done()
+
+	res := &row{hooks: s.hooks}
+	res.err = s.hooks.run(ctx, OpQueryRow, s.query, args, func(ctx context.Context, _ *QueryInfo) error {
+		bound, err := bind(s.params, args)
+		if err != nil {
+			return err
+		}
+		res.row = s.stmt.QueryRowContext(ctx, bound...)
+		return res.row.Err()
+	})
+	return res
+}
+
+// row is a *sql.Row with translated errors, or the error of binding its
+// arguments.
+type row struct {
+	row   *sql.Row
+	err   error
+	hooks *hooks
+}
+
+func (r *row) Scan(dest ...any) error {
+	if r.row == nil {
+		return r.err
+	}
+	return r.hooks.translate(r.row.Scan(dest...))
+}
+
+func (r *row) Err() error {
+	if r.row == nil {
+		return r.err
+	}
+	return r.hooks.translate(r.row.Err())
+}
+
+// DefaultStmtCacheSize is the number of prepared statements a [DB] keeps
+// unless configured otherwise with [WithStmtCacheSize].
+const DefaultStmtCacheSize = 256
+
+// WithStmtCacheSize bounds the number of cached prepared statements, the
+// least recently used statement is closed when the cache is full. A size of
+// 0 or less means unbounded.
+func WithStmtCacheSize(size int) Option {
+	return func(db *DB) {
+		db.stmtCacheSize = size
+	}
+}
+
+// StmtCacheStats are counters of the prepared statement cache.
+type StmtCacheStats struct {
+	Size      int   // Statements currently cached.
+	Hits      int64 // Queries that found their statement prepared.
+	Misses    int64 // Queries that had to prepare their statement.
+	Evictions int64 // Statements closed to make room for others.
+}
+
+// stmtCache is an LRU cache of prepared statements by query.
+type stmtCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type cacheEntry struct {
+	query   string
+	stmt    *sql.Stmt
+	params  []string // See placeholders.
+	refs    int
+	evicted bool
+}
+
+func newStmtCache(size int) *stmtCache {
+	return &stmtCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached statement for query, if any.
+func (c *stmtCache) get(query string) (*stmt, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[query]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	c.lru.MoveToFront(el)
+	return c.acquire(el.Value.(*cacheEntry)), true
+}
+
+// add caches prepared for query, along with the params of the query it was
+// prepared from, and returns it, unless another goroutine cached a statement
+// for query first, in which case that one is returned and prepared is closed.
+func (c *stmtCache) add(query string, prepared *sql.Stmt, params []string) (*stmt, error) {
+	var (
+		toClose []*sql.Stmt
+		res     *stmt
+	)
+
+	c.mu.Lock()
+	if el, ok := c.entries[query]; ok {
+		c.lru.MoveToFront(el)
+		res = c.acquire(el.Value.(*cacheEntry))
+		toClose = append(toClose, prepared)
+	} else {
+		e := &cacheEntry{query: query, stmt: prepared, params: params}
+		c.entries[query] = c.lru.PushFront(e)
+		res = c.acquire(e)
+
+		for c.size > 0 && c.lru.Len() > c.size {
+			old := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+			delete(c.entries, old.query)
+			old.evicted = true
+			c.evictions.Add(1)
+			if old.refs == 0 {
+				toClose = append(toClose, old.stmt)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	return res, closeStmts(toClose)
+}
+
+// acquire must be called with c.mu held.
+func (c *stmtCache) acquire(e *cacheEntry) *stmt {
+	e.refs++
+	return &stmt{
+		stmt:   e.stmt,
+		params: e.params,
+		release: sync.OnceFunc(func() {
+			c.mu.Lock()
+			e.refs--
+			closeNow := e.evicted && e.refs == 0
+			c.mu.Unlock()
+
+			if closeNow {
+				e.stmt.Close()
+			}
+		}),
+	}
+}
+
+// close closes every cached statement.
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	var stmts []*sql.Stmt
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		e.evicted = true
+		stmts = append(stmts, e.stmt)
+	}
+	c.lru.Init()
+	clear(c.entries)
+	c.mu.Unlock()
+
+	return closeStmts(stmts)
+}
+
+func (c *stmtCache) stats() StmtCacheStats {
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	return StmtCacheStats{
+		Size:      size,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+func closeStmts(stmts []*sql.Stmt) error {
+	var err error
+	for _, s := range stmts {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -3,36 +3,307 @@ package dbs
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sync"
 )
 
-func newTx(db *DB, tx *sql.Tx) *Tx {
+func newTx(db *DB, p *pool, tx *sql.Tx) *Tx {
 	res := &Tx{
-		tx:    tx,
-		stmts: db,
+		db:       db,
+		tx:       tx,
+		hooks:    p.hooks,
+		prepared: make(map[string]*stmt),
 	}
 	res.Queries = &Queries{stmts: res}
 	return res
 }
 
 type Tx struct {
+	db    *DB // The DB the transaction was begun on.
 	tx    *sql.Tx
-	stmts stmts
+	hooks *hooks
 	*Queries
+
+	// prepared holds the statements prepared on this transaction, so that
+	// each query is prepared, and rewritten for the dialect, once rather
+	// than on every call. Handed out as copies.
+	mu       sync.Mutex
+	prepared map[string]*stmt
+
+	// Callbacks registered with OnCommit and OnRollback, also guarded by mu.
+	// Once the transaction ended is set, and callbacks no longer run.
+	onCommit   []func()
+	onRollback []func()
+	ended      bool
+
+	// Open savepoints, innermost last, also guarded by mu.
+	savepoints   []*Savepoint
+	savepointSeq int
+
+	// done tells the DB the transaction ended, if set.
+	done func()
 }
 
+// Commit commits the transaction and then runs the [Tx.OnCommit] callbacks,
+// or the [Tx.OnRollback] ones if committing failed.
 func (tx *Tx) Commit() error {
-	return tx.tx.Commit()
+	defer tx.end()
+
+	// Failing with sql.ErrTxDone, the transaction was rolled back when its
+	// context was done, unless it had already ended.
+	err := tx.tx.Commit()
+	tx.runCallbacks(err == nil)
+	return tx.hooks.translate(err)
 }
 
+// Rollback rolls the transaction back and then runs the [Tx.OnRollback]
+// callbacks.
 func (tx *Tx) Rollback() error {
-	return tx.tx.Rollback()
+	defer tx.end()
+
+	err := tx.tx.Rollback()
+	tx.runCallbacks(false)
+	return err
+}
+
+// OnCommit registers fn to run once the transaction has committed, e.g. to
+// invalidate caches. Callbacks run in the order they are registered, a panic
+// in one is logged and doesn't keep the others from running. Callbacks
+// registered after a [Savepoint] that is rolled back are dropped.
+func (tx *Tx) OnCommit(fn func()) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+// OnRollback registers fn to run once the transaction has been rolled back,
+// as [Tx.OnCommit] does. That includes being rolled back because its context
+// was done, in which case fn runs when Commit or Rollback is called.
+func (tx *Tx) OnRollback(fn func()) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.onRollback = append(tx.onRollback, fn)
+}
+
+// end releases what a transaction held once it ended, however it did, even
+// rolled back by the database/sql package when its context was done. It runs
+// after the callbacks, so that shutting down waits for them too.
+func (tx *Tx) end() {
+	tx.closePrepared()
+	if tx.done != nil {
+		tx.done()
+	}
+}
+
+// runCallbacks runs the callbacks of a transaction that has just ended, only
+// the first time it is called.
+func (tx *Tx) runCallbacks(committed bool) {
+	tx.mu.Lock()
+	if tx.ended {
+		tx.mu.Unlock()
+		return
+	}
+	tx.ended = true
+	callbacks := tx.onRollback
+	if committed {
+		callbacks = tx.onCommit
+	}
+	tx.onCommit, tx.onRollback = nil, nil
+	tx.mu.Unlock()
+
+	for _, fn := range callbacks {
+		tx.runCallback(fn)
+	}
 }
 
-func (tx *Tx) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
-	stmt, err := tx.stmts.stmt(ctx, query)
-	if err != nil {
+func (tx *Tx) runCallback(fn func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			tx.hooks.logger().Error("transaction callback panicked", slog.Any("panic", p), slog.String("stack", string(debug.Stack())))
+		}
+	}()
+	fn()
+}
+
+func (tx *Tx) closePrepared() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	for query, s := range tx.prepared {
+		s.stmt.Close()
+		delete(tx.prepared, query)
+	}
+}
+
+func (tx *Tx) stmt(ctx context.Context, query string) (*stmt, error) {
+	tx.mu.Lock()
+	s, ok := tx.prepared[query]
+	tx.mu.Unlock()
+	if ok {
+		s := *s
+		return &s, nil
+	}
+
+	// Prepared on the transaction rather than bound from the pool's cache
+	// with StmtContext, whose errors only surface when the statement runs and
+	// would stay cached with it.
+	var (
+		prepared *sql.Stmt
+		ph       = tx.hooks.placeholders(query)
+	)
+	if err := tx.hooks.run(ctx, OpPrepare, query, nil, func(ctx context.Context, _ *QueryInfo) (err error) {
+		prepared, err = tx.tx.PrepareContext(ctx, ph.query)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
-	return tx.tx.StmtContext(ctx, stmt), nil
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if existing, ok := tx.prepared[query]; ok {
+		// Another goroutine prepared the statement first.
+		prepared.Close()
+		s := *existing
+		return &s, nil
+	}
+	s = &stmt{stmt: prepared, query: query, params: ph.params, hooks: tx.hooks}
+	tx.prepared[query] = s
+
+	res := *s
+	return &res, nil
+}
+
+var savepointNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Savepoint marks the current state of the transaction, so that the work done
+// after it can be rolled back without aborting the whole transaction. Taken
+// while other savepoints are open, it is nested in the latest one. name only
+// needs to be a valid identifier, it is made unique within the transaction.
+func (tx *Tx) Savepoint(ctx context.Context, name string) (*Savepoint, error) {
+	if !savepointNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid savepoint name: %q", name)
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.savepointSeq++
+	sp := &Savepoint{
+		tx:       tx,
+		name:     fmt.Sprintf("%s_%d", name, tx.savepointSeq),
+		onCommit: len(tx.onCommit),
+		Queries:  tx.Queries,
+	}
+	if _, err := tx.tx.ExecContext(ctx, "SAVEPOINT "+sp.name); err != nil {
+		return nil, err
+	}
+	tx.savepoints = append(tx.savepoints, sp)
+
+	return sp, nil
+}
+
+// Savepoint is a nested transaction within a [Tx]. It exposes the same
+// queries as the Tx, which keeps working as before once the savepoint is
+// released or rolled back. Releasing or rolling back a savepoint does the same
+// to the savepoints nested in it.
+type Savepoint struct {
+	tx   *Tx
+	name string
+	done bool // Guarded by tx.mu.
+
+	// onCommit is the number of OnCommit callbacks registered before the
+	// savepoint.
+	onCommit int
+
+	*Queries
+}
+
+var ErrSavepointDone = errors.New("dbs: savepoint has already been released or rolled back")
+
+// Savepoint takes a savepoint nested in sp, as [Tx.Savepoint] does.
+func (sp *Savepoint) Savepoint(ctx context.Context, name string) (*Savepoint, error) {
+	sp.tx.mu.Lock()
+	done := sp.done
+	sp.tx.mu.Unlock()
+	if done {
+		return nil, ErrSavepointDone
+	}
+
+	return sp.tx.Savepoint(ctx, name)
+}
+
+// Release keeps the work done since the savepoint as part of the enclosing
+// transaction or savepoint.
+func (sp *Savepoint) Release(ctx context.Context) error {
+	sp.tx.mu.Lock()
+	defer sp.tx.mu.Unlock()
+
+	if sp.done {
+		return ErrSavepointDone
+	}
+	sp.end()
+
+	_, err := sp.tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+sp.name)
+	return err
+}
+
+// Rollback undoes the work done since the savepoint.
+func (sp *Savepoint) Rollback(ctx context.Context) error {
+	sp.tx.mu.Lock()
+	defer sp.tx.mu.Unlock()
+
+	if sp.done {
+		return ErrSavepointDone
+	}
+	sp.end()
+
+	if _, err := sp.tx.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+sp.name); err != nil {
+		return err
+	}
+	sp.tx.onCommit = sp.tx.onCommit[:min(sp.onCommit, len(sp.tx.onCommit))]
+
+	_, err := sp.tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+sp.name)
+	return err
+}
+
+// end marks sp and the savepoints nested in it done. tx.mu must be held.
+func (sp *Savepoint) end() {
+	i := slices.Index(sp.tx.savepoints, sp)
+	for _, nested := range sp.tx.savepoints[i:] {
+		nested.done = true
+	}
+	sp.tx.savepoints = sp.tx.savepoints[:i]
+}
+
+type txKey struct{}
+
+// WithTxContext returns a context carrying tx, so that functions given it
+// run their queries in the transaction without a *Tx parameter, and without
+// being able to commit or roll it back. Queries run through the DB the
+// transaction was begun on, directly, with [DB.Q] or with helpers such as
+// [QueryOne], run in the transaction. Other DBs ignore it.
+func WithTxContext(ctx context.Context, tx *Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+// Q returns the queries of the transaction carried by ctx, see
+// [WithTxContext], or else the DB's own.
+func (db *DB) Q(ctx context.Context) *Queries {
+	if tx := db.txFrom(ctx); tx != nil {
+		return tx.Queries
+	}
+	return db.Queries
+}
+
+// txFrom returns the transaction carried by ctx, if it was begun on db.
+func (db *DB) txFrom(ctx context.Context) *Tx {
+	if tx, ok := ctx.Value(txKey{}).(*Tx); ok && tx != nil && tx.db == db {
+		return tx
+	}
+	return nil
 }
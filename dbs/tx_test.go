@@ -0,0 +1,38 @@
+package dbs
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestTxStmtErrorNotCached(t *testing.T) {
+	ctx := context.Background()
+
+	sqldb, err := sql.Open("sqlite3", "file:TestTxStmtErrorNotCached?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := New(sqldb)
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin tx: %s", err)
+	}
+	defer tx.Rollback()
+
+	const query = "SELECT count(*) FROM pets"
+	if _, err := tx.stmt(ctx, query); err == nil {
+		t.Fatalf("expected preparing a query of a missing table to fail")
+	}
+
+	if _, err := tx.tx.ExecContext(ctx, "CREATE TABLE pets (name TEXT)"); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	if _, err := QueryOne[int](ctx, tx, query); err != nil {
+		t.Errorf("failed to query table created in tx: %s", err)
+	}
+}
@@ -0,0 +1,48 @@
+package dbs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrStaleVersion is returned by [UpdateVersioned] when the row was changed
+// since it was read, or is gone.
+var ErrStaleVersion = errors.New("dbs: stale version")
+
+// UpdateVersioned updates the row of table matching where with set, only if
+// the row is still at version, read along with it from its version column.
+// The version is incremented along with the update, so that concurrent
+// updates of the same version fail with [ErrStaleVersion] but one. E.g.
+//
+//	UpdateVersioned(ctx, q, "users", "first_name = @first_name", "id = @id", version, args...)
+//
+// runs
+//
+//	UPDATE users SET first_name = @first_name, version = version + 1
+//	WHERE (id = @id) AND version = @version
+func UpdateVersioned(ctx context.Context, q Querier, table, set, where string, version int64, args ...any) error {
+	if set == "" || where == "" {
+		return fmt.Errorf("versioned update of %s: need both a SET list and a WHERE clause", table)
+	}
+	query := "UPDATE " + table + " SET " + set + ", version = version + 1 WHERE (" + where + ") AND version = @version"
+
+	stmt, err := q.stmt(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.ExecContext(ctx, append(args[:len(args):len(args)], sql.Named("version", version))...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrStaleVersion
+	}
+	return nil
+}
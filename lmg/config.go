@@ -0,0 +1,218 @@
+package lmg
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigPaths are looked up in the working directory when no config
+// file is given explicitly.
+var defaultConfigPaths = []string{"lmg.yaml", "lmg.yml", "lmg.toml"}
+
+type config struct {
+	changelogPath    string
+	driver           string
+	dsn              string
+	timeout          time.Duration
+	migrationTimeout time.Duration
+	lockTimeout      time.Duration
+}
+
+// configFile is the content of lmg.yaml or lmg.toml.
+type configFile struct {
+	Environments map[string]environment `yaml:"environments" toml:"environments"`
+}
+
+// environment is a named set of settings in a config file. Its values may
+// reference ${VAR}, which is looked up in the process environment first and
+// in Variables second.
+type environment struct {
+	Driver      string            `yaml:"driver" toml:"driver"`
+	DSN         string            `yaml:"dsn" toml:"dsn"`
+	Changelog   string            `yaml:"changelog" toml:"changelog"`
+	LockTimeout string            `yaml:"lock_timeout" toml:"lock_timeout"`
+	Variables   map[string]string `yaml:"variables" toml:"variables"`
+}
+
+// loadConfig registers the config flags on fs and parses args. Flags take
+// precedence over environment variables, which take precedence over the
+// environment selected from the config file.
+func loadConfig(sys system, fs *flag.FlagSet, args []string) (config, error) {
+	var (
+		cfg        config
+		configPath = sys.Getenv(ENV_CONFIG)
+		envName    = sys.Getenv(ENV_ENVIRONMENT)
+	)
+
+	fs.SetOutput(sys.Stdout())
+	fs.StringVar(&configPath, "config", configPath, "config file, defaults to lmg.yaml, lmg.yml or lmg.toml (env "+ENV_CONFIG+")")
+	fs.StringVar(&envName, "env", envName, "environment from the config file (env "+ENV_ENVIRONMENT+")")
+	timeout := fs.Duration("timeout", 0, "deadline for the whole run, 0 means none (env "+ENV_TIMEOUT+")")
+	migrationTimeout := fs.Duration("migration-timeout", 0, "deadline for each migration, 0 means none (env "+ENV_MIGRATION_TIMEOUT+")")
+	lockTimeout := fs.Duration("lock-timeout", 0, "how long to wait for a held lock, 0 means fail immediately (env "+ENV_LOCK_TIMEOUT+")")
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	if envName != "" {
+		if err := cfg.loadEnvironment(sys, configPath, envName); err != nil {
+			return config{}, err
+		}
+	}
+
+	for _, v := range []struct {
+		dst *string
+		key string
+	}{
+		{&cfg.changelogPath, ENV_CHANGELOG},
+		{&cfg.driver, ENV_DRIVER},
+		{&cfg.dsn, ENV_DSN},
+	} {
+		if val := sys.Getenv(v.key); val != "" {
+			*v.dst = val
+		}
+	}
+
+	for _, v := range []struct {
+		dst *time.Duration
+		key string
+	}{
+		{&cfg.timeout, ENV_TIMEOUT},
+		{&cfg.migrationTimeout, ENV_MIGRATION_TIMEOUT},
+		{&cfg.lockTimeout, ENV_LOCK_TIMEOUT},
+	} {
+		val := sys.Getenv(v.key)
+		if val == "" {
+			continue
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return config{}, fmt.Errorf("%s: %w", v.key, err)
+		}
+		*v.dst = d
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "timeout":
+			cfg.timeout = *timeout
+		case "migration-timeout":
+			cfg.migrationTimeout = *migrationTimeout
+		case "lock-timeout":
+			cfg.lockTimeout = *lockTimeout
+		}
+	})
+
+	return cfg, nil
+}
+
+// loadEnvironment sets cfg from the environment called name in the config
+// file at path, or in the first default config file found if path is empty.
+func (cfg *config) loadEnvironment(sys system, path, name string) error {
+	if path == "" {
+		for _, p := range defaultConfigPaths {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return fmt.Errorf("environment %q selected but no config file found", name)
+		}
+	}
+
+	file, err := readConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("read config %s: %w", path, err)
+	}
+
+	env, ok := file.Environments[name]
+	if !ok {
+		return fmt.Errorf("config %s: unknown environment %q", path, name)
+	}
+
+	lookup := func(key string) (string, bool) {
+		if val := sys.Getenv(key); val != "" {
+			return val, true
+		}
+		val, ok := env.Variables[key]
+		return val, ok
+	}
+
+	var lockTimeout string
+	for _, v := range []struct {
+		dst   *string
+		val   string
+		field string
+	}{
+		{&cfg.driver, env.Driver, "driver"},
+		{&cfg.dsn, env.DSN, "dsn"},
+		{&cfg.changelogPath, env.Changelog, "changelog"},
+		{&lockTimeout, env.LockTimeout, "lock_timeout"},
+	} {
+		val, err := expand(v.val, lookup)
+		if err != nil {
+			return fmt.Errorf("config %s: %s.%s: %w", path, name, v.field, err)
+		}
+		*v.dst = val
+	}
+
+	if cfg.changelogPath != "" && !filepath.IsAbs(cfg.changelogPath) {
+		cfg.changelogPath = filepath.Join(filepath.Dir(path), cfg.changelogPath)
+	}
+
+	if lockTimeout != "" {
+		if cfg.lockTimeout, err = time.ParseDuration(lockTimeout); err != nil {
+			return fmt.Errorf("config %s: %s.lock_timeout: %w", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+func readConfigFile(path string) (configFile, error) {
+	var file configFile
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return file, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &file)
+	case ".toml":
+		err = toml.Unmarshal(content, &file)
+	default:
+		err = errors.New("unsupported format, use .yaml, .yml or .toml")
+	}
+	return file, err
+}
+
+var expandRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expand replaces every ${VAR} in s, failing on variables lookup doesn't
+// know so that a missing secret doesn't silently become an empty string.
+func expand(s string, lookup func(string) (string, bool)) (string, error) {
+	var missing []string
+	res := expandRe.ReplaceAllStringFunc(s, func(m string) string {
+		key := expandRe.FindStringSubmatch(m)[1]
+		val, ok := lookup(key)
+		if !ok {
+			missing = append(missing, key)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined variables: %v", missing)
+	}
+	return res, nil
+}
@@ -1,3 +1,13 @@
 package lmg
 
+import "time"
+
 var TestRun = run
+
+var TestRetry = retry
+
+func SetRetryBackoff(d time.Duration) (restore func()) {
+	prev := retryBackoff
+	retryBackoff = d
+	return func() { retryBackoff = prev }
+}
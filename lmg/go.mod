@@ -2,4 +2,8 @@ module github.com/ek-os/lmg
 
 go 1.23.2
 
-require github.com/mattn/go-sqlite3 v1.14.24
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/mattn/go-sqlite3 v1.14.24
+	gopkg.in/yaml.v3 v3.0.1
+)
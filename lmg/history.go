@@ -0,0 +1,97 @@
+package lmg
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ek-os/lmg/internal/lmgsql"
+)
+
+// Version is recorded with every run in the history table. It can be set at
+// build time with -ldflags "-X github.com/ek-os/lmg.Version=...", otherwise
+// the module version is used.
+var Version string
+
+const (
+	OUTCOME_SUCCESS   = "success"
+	OUTCOME_FAILURE   = "failure"
+	OUTCOME_CANCELLED = "cancelled"
+)
+
+func version() string {
+	if Version != "" {
+		return Version
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Path == "github.com/ek-os/lmg" && bi.Main.Version != "" {
+			return bi.Main.Version
+		}
+		for _, dep := range bi.Deps {
+			if dep.Path == "github.com/ek-os/lmg" {
+				return dep.Version
+			}
+		}
+	}
+	return "(devel)"
+}
+
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return OUTCOME_SUCCESS
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return OUTCOME_CANCELLED
+	default:
+		return OUTCOME_FAILURE
+	}
+}
+
+// history prints every recorded run, oldest first.
+func history(ctx context.Context, sys system, args []string) error {
+	fs := flag.NewFlagSet("lmg history", flag.ContinueOnError)
+	cfg, err := loadConfig(sys, fs, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var runs []lmgsql.Run
+	if err := retry(ctx, db.IsTransient, func(ctx context.Context) error {
+		ok, err := db.HistoryTableExists(ctx)
+		if err != nil || !ok {
+			return err
+		}
+		runs, err = db.History(ctx)
+		return err
+	}); err != nil {
+		return fmt.Errorf("read history: %w", err)
+	}
+
+	w := tabwriter.NewWriter(sys.Stdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTARTED\tBY\tVERSION\tOUTCOME\tDURATION\tAPPLIED\tERROR")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			run.ID,
+			run.StartedAt.UTC().Format(time.RFC3339),
+			run.LockedBy,
+			run.Version,
+			run.Outcome,
+			run.Duration,
+			strings.Join(run.Applied, ","),
+			run.Error,
+		)
+	}
+	return w.Flush()
+}
@@ -4,19 +4,38 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 )
 
 const (
 	CHANGELOG_TABLE_NAME = "lmg_changelog"
 	LOCK_TABLE_NAME      = "lmg_lock"
+	HISTORY_TABLE_NAME   = "lmg_history"
 )
 
 type DB interface {
+	Ping(ctx context.Context) error
 	ChangelogTableExists(ctx context.Context) (bool, error)
 	CreateChangelogTable(ctx context.Context) error
 	LockTableExists(ctx context.Context) (bool, error)
 	CreateLockTable(ctx context.Context) error
+	// AcquireLock takes the lock for lockedBy, succeeding if lockedBy
+	// already holds it, or returns *ErrLocked.
+	AcquireLock(ctx context.Context, lockedBy string) error
+	ReleaseLock(ctx context.Context) error
+	HistoryTableExists(ctx context.Context) (bool, error)
+	CreateHistoryTable(ctx context.Context) error
+	RecordRun(ctx context.Context, run Run) error
+	History(ctx context.Context) ([]Run, error)
 	Exec(ctx context.Context, query string) error
+
+	// IsTransient reports whether err is a temporary condition, such as a
+	// busy database or a dropped connection, after which the failed
+	// operation may be retried.
+	IsTransient(err error) bool
+
+	Close() error
 }
 
 func Open(driver, dsn string) (DB, error) {
@@ -32,6 +51,25 @@ func Open(driver, dsn string) (DB, error) {
 	}
 }
 
+// DownPath returns the path of the down migration belonging to the migration
+// at path.
+func DownPath(path string) string {
+	return strings.TrimSuffix(path, ".sql") + ".down.sql"
+}
+
+// Run is an entry of the history table, recorded for every lmg run that
+// acquired the lock.
+type Run struct {
+	ID        int64
+	LockedBy  string
+	StartedAt time.Time
+	Version   string
+	Outcome   string
+	Duration  time.Duration
+	Applied   []string
+	Error     string
+}
+
 type ErrUnknownDriver struct {
 	Driver string
 }
@@ -39,3 +77,12 @@ type ErrUnknownDriver struct {
 func (e *ErrUnknownDriver) Error() string {
 	return fmt.Sprintf("unknown driver: %s", e.Driver)
 }
+
+type ErrLocked struct {
+	LockedBy string
+	LockedAt time.Time
+}
+
+func (e *ErrLocked) Error() string {
+	return fmt.Sprintf("locked by %s since %s", e.LockedBy, e.LockedAt.Format(time.RFC3339))
+}
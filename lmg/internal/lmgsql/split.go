@@ -0,0 +1,138 @@
+package lmgsql
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Splitter splits a migration into its statements, failing if it is cut off
+// in the middle of a string, identifier, comment or trigger body.
+type Splitter func(query string) ([]string, error)
+
+// NewSplitter returns the Splitter of driver's dialect.
+func NewSplitter(driver string) (Splitter, error) {
+	switch driver {
+	case "sqlite3":
+		return splitSQLite3, nil
+	default:
+		return nil, &ErrUnknownDriver{Driver: driver}
+	}
+}
+
+var (
+	createTriggerRe = regexp.MustCompile(`(?i)^CREATE\s+(TEMP\s+|TEMPORARY\s+)?TRIGGER\b`)
+	blockRe         = regexp.MustCompile(`(?i)\b(BEGIN|CASE|END)\b`)
+	endRe           = regexp.MustCompile(`(?i)\bEND\s*$`)
+)
+
+func splitSQLite3(query string) ([]string, error) {
+	if _, _, ok, err := parseRebuild(query); ok {
+		return []string{query}, err
+	}
+
+	var (
+		stmts []string
+		start int
+	)
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '\'', '"', '`':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated " + quoteName(c))
+			}
+			i += end + 1
+		case '[':
+			end := strings.IndexByte(query[i+1:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [identifier]")
+			}
+			i += end + 1
+		case '-':
+			if strings.HasPrefix(query[i:], "--") {
+				end := strings.IndexByte(query[i:], '\n')
+				if end < 0 {
+					i = len(query)
+				} else {
+					i += end
+				}
+			}
+		case '/':
+			if strings.HasPrefix(query[i:], "/*") {
+				end := strings.Index(query[i+2:], "*/")
+				if end < 0 {
+					return nil, errors.New("unterminated /* comment")
+				}
+				i += end + 3
+			}
+		case ';':
+			stmt := strings.TrimSpace(stripComments(query[start:i]))
+			// Statements inside a trigger body end with a semicolon, the
+			// trigger itself ends with the END closing its BEGIN.
+			if createTriggerRe.MatchString(stmt) && !triggerComplete(stmt) {
+				continue
+			}
+			if stmt != "" {
+				stmts = append(stmts, strings.TrimSpace(query[start:i+1]))
+			}
+			start = i + 1
+		}
+	}
+
+	rest := strings.TrimSpace(stripComments(query[start:]))
+	if createTriggerRe.MatchString(rest) {
+		return nil, errors.New("unterminated trigger, missing END")
+	}
+	if rest != "" {
+		stmts = append(stmts, strings.TrimSpace(query[start:]))
+	}
+	return stmts, nil
+}
+
+// triggerComplete reports whether the trigger stmt ends with the END of its
+// body, rather than with one closing a CASE in the body.
+func triggerComplete(stmt string) bool {
+	if !endRe.MatchString(stmt) {
+		return false
+	}
+
+	depth := 0
+	for _, m := range blockRe.FindAllString(stripQuoted(stmt), -1) {
+		if strings.EqualFold(m, "END") {
+			depth--
+		} else {
+			depth++
+		}
+	}
+	return depth <= 0
+}
+
+var quotedRe = regexp.MustCompile("'[^']*'|\"[^\"]*\"|`[^`]*`|\\[[^\\]]*\\]")
+
+// stripQuoted removes strings and quoted identifiers from a statement that is
+// known to be lexically complete, so that words in them aren't taken for
+// keywords.
+func stripQuoted(stmt string) string {
+	return quotedRe.ReplaceAllString(stmt, "")
+}
+
+var commentRe = regexp.MustCompile(`(?s)--[^\n]*|/\*.*?\*/`)
+
+// stripComments removes comments from a statement that is known to be
+// lexically complete. It doesn't account for comment markers in strings,
+// which is good enough to look at how the statement starts and ends.
+func stripComments(stmt string) string {
+	return commentRe.ReplaceAllString(stmt, "")
+}
+
+func quoteName(c byte) string {
+	switch c {
+	case '\'':
+		return "'string'"
+	case '"':
+		return `"identifier"`
+	default:
+		return "`identifier`"
+	}
+}
@@ -0,0 +1,48 @@
+package lmgsql
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitSQLite3(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{
+			name:  "statements",
+			query: "CREATE TABLE a (id INT); -- a; comment\nINSERT INTO a VALUES (1);",
+			want:  []string{"CREATE TABLE a (id INT);", "-- a; comment\nINSERT INTO a VALUES (1);"},
+		},
+		{
+			name: "trigger with CASE",
+			query: `CREATE TRIGGER t AFTER INSERT ON a
+BEGIN
+	UPDATE b SET kind = CASE WHEN new.id > 0 THEN 'end' ELSE 'begin' END;
+	UPDATE b SET n = CASE new.id WHEN 1 THEN 1 END + 1;
+END;
+SELECT 1;`,
+			want: []string{`CREATE TRIGGER t AFTER INSERT ON a
+BEGIN
+	UPDATE b SET kind = CASE WHEN new.id > 0 THEN 'end' ELSE 'begin' END;
+	UPDATE b SET n = CASE new.id WHEN 1 THEN 1 END + 1;
+END;`, "SELECT 1;"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitSQLite3(tt.query)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Statements don't match.\nwant: %q\ngot:  %q", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := splitSQLite3("CREATE TRIGGER t AFTER INSERT ON a BEGIN SELECT CASE WHEN 1 THEN 2 END;"); err == nil {
+		t.Errorf("Expected trigger closing only its CASE to be unterminated")
+	}
+}
@@ -3,7 +3,12 @@ package lmgsql
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 var _ DB = (*sqlite3DB)(nil)
@@ -12,6 +17,16 @@ type sqlite3DB struct {
 	db *sql.DB
 }
 
+// Close implements DB.
+func (s *sqlite3DB) Close() error {
+	return s.db.Close()
+}
+
+// Ping implements DB.
+func (s *sqlite3DB) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
 // ChangelogTableExists implements DB.
 func (s *sqlite3DB) ChangelogTableExists(ctx context.Context) (bool, error) {
 	return s.tableExists(ctx, CHANGELOG_TABLE_NAME)
@@ -62,8 +77,158 @@ func (s *sqlite3DB) CreateLockTable(ctx context.Context) error {
 	return err
 }
 
-// Exec implements DB.
+// AcquireLock implements DB.
+func (s *sqlite3DB) AcquireLock(ctx context.Context, lockedBy string) error {
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO lmg_lock (id, locked) VALUES (1, false);
+	`); err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE lmg_lock
+		SET locked = true, locked_at = CURRENT_TIMESTAMP, locked_by = :locked_by
+		WHERE id = 1 AND NOT locked`,
+		sql.Named("locked_by", lockedBy),
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		return nil
+	}
+
+	var (
+		by sql.NullString
+		at sql.NullTime
+	)
+	if err := s.db.QueryRowContext(
+		ctx,
+		"SELECT locked_by, locked_at FROM lmg_lock WHERE id = 1",
+	).Scan(&by, &at); err != nil {
+		return err
+	}
+	if by.Valid && by.String == lockedBy {
+		// Already ours, e.g. when a retried acquire had committed before
+		// failing.
+		return nil
+	}
+	return &ErrLocked{LockedBy: by.String, LockedAt: at.Time}
+}
+
+// ReleaseLock implements DB.
+func (s *sqlite3DB) ReleaseLock(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE lmg_lock SET locked = false, locked_at = NULL, locked_by = NULL WHERE id = 1;
+	`)
+	return err
+}
+
+// HistoryTableExists implements DB.
+func (s *sqlite3DB) HistoryTableExists(ctx context.Context) (bool, error) {
+	return s.tableExists(ctx, HISTORY_TABLE_NAME)
+}
+
+// CreateHistoryTable implements DB.
+func (s *sqlite3DB) CreateHistoryTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS lmg_history (
+			id 		INTEGER PRIMARY KEY,
+			locked_by 	TEXT NOT NULL,
+			started_at 	TIMESTAMP NOT NULL,
+			version 	TEXT NOT NULL,
+			outcome 	TEXT NOT NULL,
+			duration_ms 	INTEGER NOT NULL,
+			applied 	TEXT NOT NULL,
+			error 		TEXT
+		);
+	`)
+	return err
+}
+
+// RecordRun implements DB.
+func (s *sqlite3DB) RecordRun(ctx context.Context, run Run) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO lmg_history (locked_by, started_at, version, outcome, duration_ms, applied, error)
+		VALUES (:locked_by, :started_at, :version, :outcome, :duration_ms, :applied, :error)`,
+		sql.Named("locked_by", run.LockedBy),
+		sql.Named("started_at", run.StartedAt.UTC()),
+		sql.Named("version", run.Version),
+		sql.Named("outcome", run.Outcome),
+		sql.Named("duration_ms", run.Duration.Milliseconds()),
+		sql.Named("applied", strings.Join(run.Applied, "\n")),
+		sql.Named("error", sql.NullString{String: run.Error, Valid: run.Error != ""}),
+	)
+	return err
+}
+
+// History implements DB.
+func (s *sqlite3DB) History(ctx context.Context) ([]Run, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, locked_by, started_at, version, outcome, duration_ms, applied, error
+		FROM lmg_history
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		var (
+			run        Run
+			durationMS int64
+			applied    string
+			runErr     sql.NullString
+		)
+		if err := rows.Scan(
+			&run.ID, &run.LockedBy, &run.StartedAt, &run.Version,
+			&run.Outcome, &durationMS, &applied, &runErr,
+		); err != nil {
+			return nil, err
+		}
+		run.Duration = time.Duration(durationMS) * time.Millisecond
+		if applied != "" {
+			run.Applied = strings.Split(applied, "\n")
+		}
+		run.Error = runErr.String
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// Exec implements DB. Queries starting with [REBUILD_DIRECTIVE] rebuild the
+// table instead of being executed as is.
 func (s *sqlite3DB) Exec(ctx context.Context, query string) error {
-	_, err := s.db.ExecContext(ctx, query)
+	table, columns, ok, err := parseRebuild(query)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return s.rebuildTable(ctx, table, columns)
+	}
+
+	_, err = s.db.ExecContext(ctx, query)
 	return err
 }
+
+// IsTransient implements DB.
+func (s *sqlite3DB) IsTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
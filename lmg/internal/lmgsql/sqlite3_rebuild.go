@@ -0,0 +1,167 @@
+package lmgsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// REBUILD_DIRECTIVE starts a migration that rebuilds a table, e.g.
+//
+//	-- lmg:rebuild users
+//	CREATE TABLE users (
+//	    id INTEGER PRIMARY KEY,
+//	    first_name TEXT NOT NULL
+//	);
+//
+// The rest of the migration is the new definition of the table and nothing
+// else, further statements belong in a migration of their own. Columns
+// present in both definitions keep their data, indexes and triggers are
+// recreated.
+const REBUILD_DIRECTIVE = "-- lmg:rebuild "
+
+var createTableRe = regexp.MustCompile(`(?is)^\s*CREATE\s+TABLE\s+(?:"([^"]+)"|([A-Za-z_][A-Za-z0-9_]*))\s*(\(.*)$`)
+
+// parseRebuild returns the table and its new definition if query starts with
+// REBUILD_DIRECTIVE.
+func parseRebuild(query string) (table, createTable string, ok bool, err error) {
+	query = strings.TrimLeft(query, " \t\r\n")
+	if !strings.HasPrefix(query, REBUILD_DIRECTIVE) {
+		return "", "", false, nil
+	}
+
+	line, createTable, _ := strings.Cut(query, "\n")
+	table = strings.TrimSpace(strings.TrimPrefix(line, REBUILD_DIRECTIVE))
+
+	// Anything after the CREATE TABLE would run as part of the new table's
+	// definition.
+	stmts, err := splitSQLite3(createTable)
+	if err != nil {
+		return "", "", true, fmt.Errorf("rebuild %s: %w", table, err)
+	}
+	if len(stmts) != 1 {
+		return "", "", true, fmt.Errorf("rebuild %s: expected a single CREATE TABLE statement, got %d statements", table, len(stmts))
+	}
+
+	m := createTableRe.FindStringSubmatch(stmts[0])
+	if m == nil {
+		return "", "", true, fmt.Errorf("rebuild %s: expected a single CREATE TABLE statement", table)
+	}
+	if name := m[1] + m[2]; name != table {
+		return "", "", true, fmt.Errorf("rebuild %s: CREATE TABLE defines %s", table, name)
+	}
+	return table, m[3], true, nil
+}
+
+// rebuildTable replaces table with one defined by columns, the parenthesized
+// part of a CREATE TABLE statement, following the procedure SQLite documents
+// for schema changes ALTER TABLE doesn't support:
+// https://www.sqlite.org/lang_altertable.html#otheralter
+func (s *sqlite3DB) rebuildTable(ctx context.Context, table, columns string) (err error) {
+	// Foreign key enforcement is a connection setting that can't be changed
+	// inside a transaction, so everything must happen on one connection.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var foreignKeys bool
+	if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		return err
+	}
+	if foreignKeys {
+		if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			return err
+		}
+		defer func() {
+			if _, ferr := conn.ExecContext(context.WithoutCancel(ctx), "PRAGMA foreign_keys = ON"); ferr != nil && err == nil {
+				err = ferr
+			}
+		}()
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	schema, err := queryStrings(ctx, tx,
+		"SELECT sql FROM sqlite_master WHERE tbl_name = ? AND type IN ('index', 'trigger') AND sql IS NOT NULL",
+		table,
+	)
+	if err != nil {
+		return err
+	}
+
+	tmp := "lmg_rebuild_" + table
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s %s", quoteIdent(tmp), columns)); err != nil {
+		return fmt.Errorf("create new table: %w", err)
+	}
+
+	common, err := queryStrings(ctx, tx,
+		"SELECT o.name FROM pragma_table_info(?) o JOIN pragma_table_info(?) n USING (name) ORDER BY o.cid",
+		table, tmp,
+	)
+	if err != nil {
+		return err
+	}
+	for i, c := range common {
+		common[i] = quoteIdent(c)
+	}
+	cols := strings.Join(common, ", ")
+
+	for _, stmt := range []string{
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteIdent(tmp), cols, cols, quoteIdent(table)),
+		fmt.Sprintf("DROP TABLE %s", quoteIdent(table)),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteIdent(tmp), quoteIdent(table)),
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+
+	for _, stmt := range schema {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("recreate %q: %w", stmt, err)
+		}
+	}
+
+	// Rows of other tables may reference the rebuilt table too.
+	violations, err := queryStrings(ctx, tx,
+		"SELECT \"table\" || ' rowid ' || ifnull(rowid, '?') || ' references ' || parent FROM pragma_foreign_key_check",
+	)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("foreign key check failed: %s", strings.Join(violations, "; "))
+	}
+
+	return tx.Commit()
+}
+
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,87 @@
+package lmgsql
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRebuildRejectsTrailingStatements(t *testing.T) {
+	db := openRebuildTestDB(t, "lmg-rebuild-trailing")
+
+	err := db.Exec(context.Background(), `-- lmg:rebuild members
+CREATE TABLE members (
+    id INTEGER PRIMARY KEY,
+    team_id INTEGER NOT NULL REFERENCES teams (id),
+    name TEXT NOT NULL
+);
+CREATE INDEX members_name ON members (name);`)
+	if err == nil || !strings.Contains(err.Error(), "expected a single CREATE TABLE statement") {
+		t.Fatalf("Expected trailing statement to be rejected, got %v", err)
+	}
+
+	// A trailing comment is fine.
+	err = db.Exec(context.Background(), `-- lmg:rebuild members
+CREATE TABLE members (
+    id INTEGER PRIMARY KEY,
+    team_id INTEGER NOT NULL REFERENCES teams (id),
+    name TEXT NOT NULL
+);
+-- Names are no longer optional.`)
+	if err != nil {
+		t.Fatalf("Failed to rebuild: %s", err)
+	}
+}
+
+func TestRebuildChecksReferencingTables(t *testing.T) {
+	db := openRebuildTestDB(t, "lmg-rebuild-referenced")
+
+	// A member of a team that doesn't exist, which the rebuild of teams must
+	// not let through.
+	if err := db.Exec(context.Background(), `PRAGMA foreign_keys = OFF;
+INSERT INTO members (id, team_id, name) VALUES (2, 42, 'orphan');
+PRAGMA foreign_keys = ON;`); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.Exec(context.Background(), `-- lmg:rebuild teams
+CREATE TABLE teams (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);`)
+	if err == nil || !strings.Contains(err.Error(), "members rowid 2 references teams") {
+		t.Fatalf("Expected foreign key check to fail, got %v", err)
+	}
+
+	var sql string
+	if err := db.(*sqlite3DB).db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'teams'").Scan(&sql); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sql, "UNIQUE") {
+		t.Errorf("Expected teams to be left as they were, got %s", sql)
+	}
+}
+
+func openRebuildTestDB(t *testing.T, name string) DB {
+	t.Helper()
+
+	db, err := Open("sqlite3", "file:"+name+"?mode=memory&cache=shared&_foreign_keys=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, query := range []string{
+		"CREATE TABLE teams (id INTEGER PRIMARY KEY, name TEXT NOT NULL)",
+		"CREATE TABLE members (id INTEGER PRIMARY KEY, team_id INTEGER NOT NULL REFERENCES teams (id), name TEXT)",
+		"INSERT INTO teams (id, name) VALUES (1, 'core')",
+		"INSERT INTO members (id, team_id, name) VALUES (1, 1, 'ek')",
+	} {
+		if err := db.Exec(context.Background(), query); err != nil {
+			t.Fatalf("Failed to set up %q: %s", query, err)
+		}
+	}
+	return db
+}
@@ -3,10 +3,16 @@ package lmg
 import (
 	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ek-os/lmg/internal/lmgsql"
 )
@@ -15,10 +21,28 @@ const (
 	ENV_CHANGELOG = "LMG_CHANGELOG_PATH"
 	ENV_DRIVER    = "LMG_DRIVER"
 	ENV_DSN       = "LMG_DSN"
+
+	ENV_TIMEOUT           = "LMG_TIMEOUT"
+	ENV_MIGRATION_TIMEOUT = "LMG_MIGRATION_TIMEOUT"
+	ENV_LOCK_TIMEOUT      = "LMG_LOCK_TIMEOUT"
+
+	ENV_CONFIG      = "LMG_CONFIG"
+	ENV_ENVIRONMENT = "LMG_ENV"
 )
 
+// releaseTimeout bounds how long releasing the lock may take once the run
+// itself has been cancelled or has timed out.
+const releaseTimeout = 10 * time.Second
+
+// lockPollInterval is how often a held lock is retried while waiting up to
+// the lock timeout.
+var lockPollInterval = time.Second
+
 func Run() {
-	if err := run(context.Background(), realSystem{}); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, realSystem{})
+	stop()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
@@ -26,7 +50,9 @@ func Run() {
 
 type system interface {
 	Getenv(key string) string
+	Args() []string
 	Stdout() io.Writer
+	Now() time.Time
 }
 
 type realSystem struct{}
@@ -35,40 +61,193 @@ func (realSystem) Getenv(key string) string {
 	return os.Getenv(key)
 }
 
+func (realSystem) Args() []string {
+	return os.Args[1:]
+}
+
 func (realSystem) Stdout() io.Writer {
 	return os.Stdout
 }
 
+func (realSystem) Now() time.Time {
+	return time.Now()
+}
+
 func run(ctx context.Context, sys system) error {
-	var (
-		changelogPath = sys.Getenv(ENV_CHANGELOG)
-		driver        = sys.Getenv(ENV_DRIVER)
-		dsn           = sys.Getenv(ENV_DSN)
-	)
+	cmd, args := "up", sys.Args()
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "up":
+		return up(ctx, sys, args)
+	case "new":
+		return newMigration(sys, args)
+	case "history":
+		return history(ctx, sys, args)
+	case "validate":
+		return validate(sys, args)
+	default:
+		return fmt.Errorf("unknown command: %s", cmd)
+	}
+}
+
+func up(ctx context.Context, sys system, args []string) error {
+	fs := flag.NewFlagSet("lmg", flag.ContinueOnError)
+	cfg, err := loadConfig(sys, fs, args)
+	if err != nil {
+		return err
+	}
 
-	db, err := lmgsql.Open(driver, dsn)
+	return migrate(ctx, sys, cfg)
+}
+
+// Migrate applies the changelog at changelogPath to the database, the same
+// way running lmg with the corresponding environment variables does.
+func Migrate(ctx context.Context, driver, dsn, changelogPath string) error {
+	return migrate(ctx, realSystem{}, config{
+		changelogPath: changelogPath,
+		driver:        driver,
+		dsn:           dsn,
+	})
+}
+
+// Migrations returns the paths of the migrations listed in the changelog at
+// changelogPath, in order.
+func Migrations(changelogPath string) ([]string, error) {
+	return readChangelog(changelogPath)
+}
+
+func migrate(ctx context.Context, sys system, cfg config) (err error) {
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+
+	db, err := openDB(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("lmgsql.Open: %w", err)
+		return err
 	}
+	defer db.Close()
 
-	if err := ensureLockTableExists(ctx, db); err != nil {
+	if err := retry(ctx, db.IsTransient, func(ctx context.Context) error {
+		if err := ensureLockTableExists(ctx, db); err != nil {
+			return err
+		}
+		return ensureHistoryTableExists(ctx, db)
+	}); err != nil {
 		return err
 	}
 
-	migrations, err := readChangelog(changelogPath)
+	migrations, err := readChangelog(cfg.changelogPath)
 	if err != nil {
 		return fmt.Errorf("read changelog: %w", err)
 	}
 
-	for _, migration := range migrations {
-		if err := executeMigration(ctx, db, migration); err != nil {
+	var (
+		owner   = lockOwner()
+		started = sys.Now()
+		applied []string
+	)
+	if err := acquireLock(ctx, db, owner, cfg.lockTimeout); err != nil {
+		return fmt.Errorf("acquire lock: %w", err)
+	}
+	defer func() {
+		// The run context may already be cancelled, the lock must be released
+		// regardless.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+		defer cancel()
+
+		if rerr := retry(ctx, db.IsTransient, db.ReleaseLock); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("release lock: %w", rerr))
+		}
+	}()
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+		defer cancel()
+
+		run := lmgsql.Run{
+			LockedBy:  owner,
+			StartedAt: started,
+			Version:   version(),
+			Outcome:   outcome(err),
+			Duration:  sys.Now().Sub(started),
+			Applied:   applied,
+		}
+		if err != nil {
+			run.Error = err.Error()
+		}
+		if herr := db.RecordRun(ctx, run); herr != nil {
+			err = errors.Join(err, fmt.Errorf("record history: %w", herr))
+		}
+	}()
+
+	for i, migration := range migrations {
+		if err := executeMigration(ctx, db, migration, cfg.migrationTimeout); err != nil {
+			printReport(sys.Stdout(), migrations, i, err)
 			return fmt.Errorf("execute %s: %w", migration, err)
 		}
+		applied = append(applied, migration)
 	}
 
 	return nil
 }
 
+// printReport describes a run that stopped at migrations[failed].
+func printReport(w io.Writer, migrations []string, failed int, err error) {
+	fmt.Fprintf(w, "lmg: run stopped after %d of %d migrations\n", failed, len(migrations))
+	for i, migration := range migrations {
+		switch {
+		case i < failed:
+			fmt.Fprintf(w, "  applied  %s\n", migration)
+		case i == failed:
+			fmt.Fprintf(w, "  failed   %s: %s\n", migration, err)
+		default:
+			fmt.Fprintf(w, "  pending  %s\n", migration)
+		}
+	}
+}
+
+// acquireLock takes the migration lock, waiting up to timeout for another
+// run to release it.
+func acquireLock(ctx context.Context, db lmgsql.DB, owner string, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	for {
+		err := retry(ctx, db.IsTransient, func(ctx context.Context) error {
+			return db.AcquireLock(ctx, owner)
+		})
+
+		var lerr *lmgsql.ErrLocked
+		if timeout <= 0 || !errors.As(err, &lerr) {
+			return err
+		}
+
+		t := time.NewTimer(lockPollInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
 func ensureChangelogTableExists(ctx context.Context, db lmgsql.DB) error {
 	ok, err := db.ChangelogTableExists(ctx)
 	if err != nil {
@@ -84,6 +263,20 @@ func ensureChangelogTableExists(ctx context.Context, db lmgsql.DB) error {
 	return nil
 }
 
+func openDB(ctx context.Context, cfg config) (lmgsql.DB, error) {
+	db, err := lmgsql.Open(cfg.driver, cfg.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("lmgsql.Open: %w", err)
+	}
+
+	if err := retry(ctx, db.IsTransient, db.Ping); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping: %w", err)
+	}
+
+	return db, nil
+}
+
 func ensureLockTableExists(ctx context.Context, db lmgsql.DB) error {
 	ok, err := db.LockTableExists(ctx)
 	if err != nil {
@@ -99,6 +292,21 @@ func ensureLockTableExists(ctx context.Context, db lmgsql.DB) error {
 	return nil
 }
 
+func ensureHistoryTableExists(ctx context.Context, db lmgsql.DB) error {
+	ok, err := db.HistoryTableExists(ctx)
+	if err != nil {
+		return fmt.Errorf("check if history table exists: %w", err)
+	}
+
+	if !ok {
+		if err := db.CreateHistoryTable(ctx); err != nil {
+			return fmt.Errorf("create history table: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func readChangelog(path string) ([]string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -126,12 +334,18 @@ func readChangelog(path string) ([]string, error) {
 	return migrationPaths, nil
 }
 
-func executeMigration(ctx context.Context, db lmgsql.DB, path string) error {
+func executeMigration(ctx context.Context, db lmgsql.DB, path string, timeout time.Duration) error {
 	query, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	if err := db.Exec(ctx, string(query)); err != nil {
 		return fmt.Errorf("exec: %w", err)
 	}
@@ -5,16 +5,24 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ek-os/lmg"
+	"github.com/ek-os/lmg/internal/lmgsql"
+	"github.com/ek-os/lmg/lmgtest"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func TestCorrectlyHandlesTrailingWhitespace(t *testing.T) {
+	// Keeps the in-memory database alive after lmg closes its connections.
+	db := lmgtest.Open(t, driver, persistentDSN)
+
 	sys := newTestSystem(map[string]string{
 		lmg.ENV_CHANGELOG: "testdata/changelog-whitespace.txt",
 		lmg.ENV_DSN:       persistentDSN,
@@ -24,48 +32,406 @@ func TestCorrectlyHandlesTrailingWhitespace(t *testing.T) {
 	err := lmg.TestRun(context.Background(), sys)
 	noErr(t, err)
 
-	db, err := openTestDB(driver, persistentDSN)
+	db.AssertTableExists("users")
+}
+
+func TestCorrectlyAppliesChangelog(t *testing.T) {
+	// Keeps the in-memory database alive after lmg closes its connections.
+	db := lmgtest.Open(t, driver, persistentDSN)
+
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG: "testdata/changelog.txt",
+		lmg.ENV_DSN:       persistentDSN,
+		lmg.ENV_DRIVER:    driver,
+	})
+
+	err := lmg.TestRun(context.Background(), sys)
 	noErr(t, err)
 
-	exists, err := db.tableExists("users")
+	db.AssertTableExists("users")
+}
+
+func TestFailFindMigration(t *testing.T) {
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG: "testdata/changelog-dud.txt",
+		lmg.ENV_DSN:       transientDSN,
+		lmg.ENV_DRIVER:    driver,
+	})
+
+	err := lmg.TestRun(context.Background(), sys)
+
+	errIsString(t, err, "execute testdata/migrations/bar.sql: open testdata/migrations/bar.sql: no such file or directory")
+}
+
+func TestMigrationTimeoutReleasesLock(t *testing.T) {
+	const dsn = "file:lmg-timeout?mode=memory&cache=shared"
+
+	db := lmgtest.Open(t, driver, dsn)
+
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG:         "testdata/changelog-slow.txt",
+		lmg.ENV_DSN:               dsn,
+		lmg.ENV_DRIVER:            driver,
+		lmg.ENV_MIGRATION_TIMEOUT: "50ms",
+	})
+
+	err := lmg.TestRun(context.Background(), sys)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got: %v", err)
+	}
+
+	report := sys.stdout.String()
+	for _, want := range []string{
+		"failed   testdata/migrations/slow.sql",
+		"pending  testdata/migrations/foo.sql",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Report doesn't contain %q:\n%s", want, report)
+		}
+	}
+
+	var locked bool
+	err = db.SQL.QueryRow("SELECT locked FROM lmg_lock WHERE id = 1").Scan(&locked)
 	noErr(t, err)
 
-	if !exists {
-		t.Errorf(`Expected table "users" to be present`)
+	if locked {
+		t.Errorf("Expected lock to be released")
 	}
+
+	db.AssertTableNotExists("users")
 }
 
-func TestCorrectlyAppliesChangelog(t *testing.T) {
+func TestFailWhenLocked(t *testing.T) {
+	const dsn = "file:lmg-locked?mode=memory&cache=shared"
+
+	sqldb, err := sql.Open(driver, dsn)
+	noErr(t, err)
+	defer sqldb.Close()
+
+	_, err = sqldb.Exec(`
+		CREATE TABLE lmg_lock (id INT NOT NULL PRIMARY KEY, locked BOOLEAN NOT NULL, locked_at TIMESTAMP, locked_by TEXT);
+		INSERT INTO lmg_lock VALUES (1, true, '2024-10-01 12:00:00', 'elsewhere:1');
+	`)
+	noErr(t, err)
+
 	sys := newTestSystem(map[string]string{
 		lmg.ENV_CHANGELOG: "testdata/changelog.txt",
-		lmg.ENV_DSN:       persistentDSN,
+		lmg.ENV_DSN:       dsn,
+		lmg.ENV_DRIVER:    driver,
+	})
+
+	err = lmg.TestRun(context.Background(), sys)
+
+	errIsString(t, err, "acquire lock: locked by elsewhere:1 since 2024-10-01T12:00:00Z")
+}
+
+func TestAcquireLockHeldByOwner(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := lmgsql.Open(driver, "file:lmg-own-lock?mode=memory&cache=shared")
+	noErr(t, err)
+	defer db.Close()
+	noErr(t, db.CreateLockTable(ctx))
+
+	// A retried acquire whose first attempt did go through.
+	noErr(t, db.AcquireLock(ctx, "here:1"))
+	noErr(t, db.AcquireLock(ctx, "here:1"))
+
+	var lerr *lmgsql.ErrLocked
+	if err := db.AcquireLock(ctx, "elsewhere:1"); !errors.As(err, &lerr) || lerr.LockedBy != "here:1" {
+		t.Errorf("expected lock held by here:1, got %v", err)
+	}
+}
+
+func TestTimeoutFlagOverridesEnv(t *testing.T) {
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG: "testdata/changelog-slow.txt",
+		lmg.ENV_DSN:       transientDSN,
+		lmg.ENV_DRIVER:    driver,
+		lmg.ENV_TIMEOUT:   "1h",
+	}, "-timeout", "50ms")
+
+	err := lmg.TestRun(context.Background(), sys)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got: %v", err)
+	}
+}
+
+func TestFailInvalidTimeout(t *testing.T) {
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG: "testdata/changelog.txt",
+		lmg.ENV_DSN:       transientDSN,
 		lmg.ENV_DRIVER:    driver,
+		lmg.ENV_TIMEOUT:   "soon",
+	})
+
+	err := lmg.TestRun(context.Background(), sys)
+
+	errIsString(t, err, `LMG_TIMEOUT: time: invalid duration "soon"`)
+}
+
+func TestRetry(t *testing.T) {
+	defer lmg.SetRetryBackoff(time.Millisecond)()
+
+	var (
+		errTransient = errors.New("transient")
+		errPermanent = errors.New("permanent")
+		isTransient  = func(err error) bool { return errors.Is(err, errTransient) }
+	)
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{"succeeds after transient errors", []error{errTransient, errTransient, nil}, nil, 3},
+		{"stops on permanent error", []error{errTransient, errPermanent, nil}, errPermanent, 2},
+		{"gives up", []error{errTransient, errTransient, errTransient, errTransient, errTransient, nil}, errTransient, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := lmg.TestRetry(context.Background(), isTransient, func(context.Context) error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("want error %v, got %v", tt.wantErr, err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("want %d calls, got %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestNewMigration(t *testing.T) {
+	dir := t.TempDir()
+	changelog := filepath.Join(dir, "changelog.txt")
+	noErr(t, os.WriteFile(changelog, []byte("migrations/foo.sql"), 0o644))
+
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG: changelog,
+	}, "new", "-down", "add_users_email")
+
+	err := lmg.TestRun(context.Background(), sys)
+	noErr(t, err)
+
+	for _, name := range []string{
+		"20241001123000_add_users_email.sql",
+		"20241001123000_add_users_email.down.sql",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, "migrations", name)); err != nil {
+			t.Errorf("Expected %s to be created: %s", name, err)
+		}
+	}
+
+	content, err := os.ReadFile(changelog)
+	noErr(t, err)
+
+	want := "migrations/foo.sql\nmigrations/20241001123000_add_users_email.sql\n"
+	if string(content) != want {
+		t.Errorf("Changelog doesn't match.\nwant: %q\ngot:  %q", want, content)
+	}
+
+	err = lmg.TestRun(context.Background(), sys)
+	if err == nil || !strings.HasSuffix(err.Error(), "20241001123000_add_users_email.sql already exists") {
+		t.Errorf("Expected existing migration not to be overwritten, got: %v", err)
+	}
+}
+
+func TestNewMigrationSequence(t *testing.T) {
+	dir := t.TempDir()
+	changelog := filepath.Join(dir, "changelog.txt")
+	noErr(t, os.Mkdir(filepath.Join(dir, "sql"), 0o755))
+	noErr(t, os.WriteFile(filepath.Join(dir, "sql", "0007_create_users.sql"), nil, 0o644))
+
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG: changelog,
+	}, "new", "-seq", "-dir", "sql", "add_users_email")
+
+	err := lmg.TestRun(context.Background(), sys)
+	noErr(t, err)
+
+	content, err := os.ReadFile(changelog)
+	noErr(t, err)
+
+	want := "sql/0008_add_users_email.sql\n"
+	if string(content) != want {
+		t.Errorf("Changelog doesn't match.\nwant: %q\ngot:  %q", want, content)
+	}
+}
+
+func TestFailNewMigrationInvalidName(t *testing.T) {
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG: filepath.Join(t.TempDir(), "changelog.txt"),
+	}, "new", "../users")
+
+	err := lmg.TestRun(context.Background(), sys)
+
+	errIsString(t, err, `invalid migration name "../users": only letters, digits, '_' and '-' are allowed`)
+}
+
+func TestConfigFile(t *testing.T) {
+	testdata, err := filepath.Abs("testdata")
+	noErr(t, err)
+
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "lmg.yaml")
+	noErr(t, os.WriteFile(yamlPath, []byte(`
+environments:
+  local:
+    driver: sqlite3
+    dsn: file:${DB_NAME}?mode=memory&cache=shared
+    changelog: ${TESTDATA}/changelog.txt
+    lock_timeout: 5s
+    variables:
+      DB_NAME: lmg-config-yaml
+`), 0o644))
+
+	tomlPath := filepath.Join(dir, "lmg.toml")
+	noErr(t, os.WriteFile(tomlPath, []byte(`
+[environments.prod]
+driver = "postgres"
+dsn = "postgres://${DB_USER}@db/app"
+changelog = "${TESTDATA}/changelog.txt"
+`), 0o644))
+
+	t.Run("yaml", func(t *testing.T) {
+		db := lmgtest.Open(t, driver, "file:lmg-config-yaml?mode=memory&cache=shared")
+
+		sys := newTestSystem(map[string]string{
+			"TESTDATA": testdata,
+		}, "-config", yamlPath, "-env", "local")
+
+		err := lmg.TestRun(context.Background(), sys)
+		noErr(t, err)
+
+		db.AssertTableExists("users")
+	})
+
+	t.Run("env vars take precedence", func(t *testing.T) {
+		db := lmgtest.Open(t, driver, "file:lmg-config-toml?mode=memory&cache=shared")
+
+		sys := newTestSystem(map[string]string{
+			"TESTDATA":          testdata,
+			"DB_USER":           "app",
+			lmg.ENV_DRIVER:      driver,
+			lmg.ENV_DSN:         "file:lmg-config-toml?mode=memory&cache=shared",
+			lmg.ENV_ENVIRONMENT: "prod",
+		}, "-config", tomlPath)
+
+		err := lmg.TestRun(context.Background(), sys)
+		noErr(t, err)
+
+		db.AssertTableExists("users")
+	})
+
+	t.Run("undefined variable", func(t *testing.T) {
+		sys := newTestSystem(map[string]string{
+			"TESTDATA": testdata,
+		}, "-config", tomlPath, "-env", "prod")
+
+		err := lmg.TestRun(context.Background(), sys)
+
+		errIsString(t, err, "config "+tomlPath+": prod.dsn: undefined variables: [DB_USER]")
 	})
 
+	t.Run("unknown environment", func(t *testing.T) {
+		sys := newTestSystem(nil, "-config", yamlPath, "-env", "staging")
+
+		err := lmg.TestRun(context.Background(), sys)
+
+		errIsString(t, err, "config "+yamlPath+`: unknown environment "staging"`)
+	})
+}
+
+func TestHistory(t *testing.T) {
+	const dsn = "file:lmg-history?mode=memory&cache=shared"
+	lmgtest.Open(t, driver, dsn)
+
+	for _, changelog := range []string{"testdata/changelog.txt", "testdata/changelog-dud.txt"} {
+		sys := newTestSystem(map[string]string{
+			lmg.ENV_CHANGELOG: changelog,
+			lmg.ENV_DSN:       dsn,
+			lmg.ENV_DRIVER:    driver,
+		})
+		_ = lmg.TestRun(context.Background(), sys)
+	}
+
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_DSN:    dsn,
+		lmg.ENV_DRIVER: driver,
+	}, "history")
+
 	err := lmg.TestRun(context.Background(), sys)
 	noErr(t, err)
 
-	db, err := openTestDB(driver, persistentDSN)
+	lines := strings.Split(strings.TrimSpace(sys.stdout.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected header and 2 runs, got:\n%s", sys.stdout)
+	}
+	for i, want := range []string{
+		"2024-10-01T12:30:00Z success testdata/migrations/foo.sql",
+		"2024-10-01T12:30:00Z failure execute testdata/migrations/bar.sql: open testdata/migrations/bar.sql: no such file or directory",
+	} {
+		fields := strings.Fields(lines[i+1])
+		got := strings.Join(append([]string{fields[1], fields[4]}, fields[6:]...), " ")
+		if got != want {
+			t.Errorf("Run %d doesn't match.\nwant: %q\ngot:  %q", i+1, want, got)
+		}
+	}
+}
+
+func TestRebuildTable(t *testing.T) {
+	const dsn = "file:lmg-rebuild?mode=memory&cache=shared&_foreign_keys=1"
+
+	db := lmgtest.Open(t, driver, dsn)
+	db.Apply("testdata/changelog-rebuild.txt")
+
+	db.AssertColumnExists("members", "team_id")
+	db.AssertColumnNotExists("members", "nickname")
+	db.AssertIndexExists("members", "members_team_id")
+	db.AssertTableNotExists("lmg_rebuild_members")
+
+	var name string
+	err := db.SQL.QueryRow("SELECT name FROM members WHERE id = 1").Scan(&name)
 	noErr(t, err)
 
-	exists, err := db.tableExists("users")
+	if name != "ek" {
+		t.Errorf("Expected member data to be kept, got name %q", name)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	sys := newTestSystem(map[string]string{
+		lmg.ENV_CHANGELOG: "testdata/changelog-valid.txt",
+		lmg.ENV_DRIVER:    driver,
+	}, "validate", "-sql")
+
+	err := lmg.TestRun(context.Background(), sys)
 	noErr(t, err)
 
-	if !exists {
-		t.Errorf(`Expected table "users" to be present`)
+	if got, want := sys.stdout.String(), "testdata/changelog-valid.txt: 4 migrations ok\n"; got != want {
+		t.Errorf("Output doesn't match.\nwant: %q\ngot:  %q", want, got)
 	}
 }
 
-func TestFailFindMigration(t *testing.T) {
+func TestFailValidate(t *testing.T) {
 	sys := newTestSystem(map[string]string{
-		lmg.ENV_CHANGELOG: "testdata/changelog-dud.txt",
-		lmg.ENV_DSN:       transientDSN,
+		lmg.ENV_CHANGELOG: "testdata/changelog-invalid.txt",
 		lmg.ENV_DRIVER:    driver,
-	})
+	}, "validate", "-sql")
 
 	err := lmg.TestRun(context.Background(), sys)
 
-	errIsString(t, err, "execute testdata/migrations/bar.sql: open testdata/migrations/bar.sql: no such file or directory")
+	errIsString(t, err, strings.Join([]string{
+		"testdata/migrations/unterminated.sql: unterminated 'string'",
+		"testdata/migrations/foo.sql: listed more than once",
+		"go.mod: outside of the changelog directory testdata",
+		"testdata/migrations/bar.sql: open testdata/migrations/bar.sql: no such file or directory",
+	}, "\n"))
 }
 
 func TestFailReadChangelog(t *testing.T) {
@@ -87,15 +453,19 @@ const (
 	transientDSN  = ":memory:"
 )
 
-func newTestSystem(env map[string]string) testSystem {
+var testNow = time.Date(2024, 10, 1, 12, 30, 0, 0, time.UTC)
+
+func newTestSystem(env map[string]string, args ...string) testSystem {
 	return testSystem{
 		env:    env,
+		args:   args,
 		stdout: &bytes.Buffer{},
 	}
 }
 
 type testSystem struct {
 	env    map[string]string
+	args   []string
 	stdout *bytes.Buffer
 }
 
@@ -106,10 +476,18 @@ func (t testSystem) Getenv(key string) string {
 	return ""
 }
 
+func (t testSystem) Args() []string {
+	return t.args
+}
+
 func (t testSystem) Stdout() io.Writer {
 	return t.stdout
 }
 
+func (t testSystem) Now() time.Time {
+	return testNow
+}
+
 func errIsString(t *testing.T, err error, want string) {
 	t.Helper()
 	got := err.Error()
@@ -118,67 +496,6 @@ func errIsString(t *testing.T, err error, want string) {
 	}
 }
 
-func openTestDB(driver, dsn string) (testDB, error) {
-	switch driver {
-	case "sqlite3":
-		db, err := sql.Open(driver, dsn)
-		if err != nil {
-			return nil, err
-		}
-		return &sqlite3TestDB{db: db}, nil
-	default:
-		return nil, fmt.Errorf("Unknown driver: %s", driver)
-	}
-}
-
-type testDB interface {
-	tableExists(table string) (bool, error)
-	assertTableExists(table string) func(t *testing.T)
-	assertTableDoesntExist(table string) func(t *testing.T)
-}
-
-type sqlite3TestDB struct {
-	db *sql.DB
-}
-
-func (db *sqlite3TestDB) tableExists(table string) (bool, error) {
-	var exists bool
-	if err := db.db.QueryRow(
-		"SELECT true FROM sqlite_master WHERE name = :name",
-		sql.Named("name", table),
-	).Scan(&exists); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return false, nil
-		}
-		return false, err
-	}
-	return exists, nil
-}
-
-// assertTableExists implements testDB.
-func (db *sqlite3TestDB) assertTableExists(table string) func(t *testing.T) {
-	return func(t *testing.T) {
-		ok, err := db.tableExists(table)
-		noErr(t, err)
-
-		if !ok {
-			t.Errorf(`Expected table %q to be present`, table)
-		}
-	}
-}
-
-// assertTableDoesntExist implements testDB.
-func (db *sqlite3TestDB) assertTableDoesntExist(table string) func(t *testing.T) {
-	return func(t *testing.T) {
-		ok, err := db.tableExists(table)
-		noErr(t, err)
-
-		if ok {
-			t.Errorf(`Expected table %q to not be present`, table)
-		}
-	}
-}
-
 func noErr(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -0,0 +1,206 @@
+// Package lmgtest helps service test suites verify their lmg migrations.
+package lmgtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ek-os/lmg"
+	"github.com/ek-os/lmg/internal/lmgsql"
+)
+
+var dbCount atomic.Int64
+
+// DB is a database under test. All of its methods fail the test they were
+// created with instead of returning errors.
+type DB struct {
+	Driver string
+	DSN    string
+
+	// SQL is kept open for the whole test, which also keeps a fresh
+	// in-memory database alive.
+	SQL *sql.DB
+
+	t testing.TB
+}
+
+// New returns a fresh, empty in-memory SQLite database that only lives as
+// long as the test.
+func New(t testing.TB) *DB {
+	t.Helper()
+	dsn := fmt.Sprintf("file:lmgtest-%d?mode=memory&cache=shared", dbCount.Add(1))
+	return Open(t, "sqlite3", dsn)
+}
+
+// Open returns the database at dsn. The database is not cleaned up, so it
+// should be dedicated to the test.
+func Open(t testing.TB, driver, dsn string) *DB {
+	t.Helper()
+
+	if driver != "sqlite3" {
+		t.Fatalf("lmgtest: unsupported driver: %s", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("lmgtest: open %s: %s", dsn, err)
+	}
+	// Keep at least one connection around so a shared in-memory database
+	// isn't dropped between queries.
+	if err := db.Ping(); err != nil {
+		t.Fatalf("lmgtest: ping %s: %s", dsn, err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &DB{
+		Driver: driver,
+		DSN:    dsn,
+		SQL:    db,
+		t:      t,
+	}
+}
+
+// Apply runs lmg against the database with the changelog at changelogPath.
+func (db *DB) Apply(changelogPath string) {
+	db.t.Helper()
+	if err := lmg.Migrate(context.Background(), db.Driver, db.DSN, changelogPath); err != nil {
+		db.t.Fatalf("lmgtest: apply %s: %s", changelogPath, err)
+	}
+}
+
+// RoundTrip applies every migration in the changelog at changelogPath, then
+// its down migration, then the migration again, proving that the down
+// migration restores the schema from before the migration and that the
+// migration can be applied anew. It stops at the first migration that can't
+// be round-tripped, including one without a down migration.
+func (db *DB) RoundTrip(changelogPath string) {
+	db.t.Helper()
+
+	migrations, err := lmg.Migrations(changelogPath)
+	if err != nil {
+		db.t.Fatalf("lmgtest: read changelog: %s", err)
+	}
+
+	ldb, err := lmgsql.Open(db.Driver, db.DSN)
+	if err != nil {
+		db.t.Fatalf("lmgtest: %s", err)
+	}
+	defer ldb.Close()
+
+	ctx := context.Background()
+	for _, up := range migrations {
+		down := lmgsql.DownPath(up)
+
+		// The schema before each step, which the down migration must
+		// restore.
+		var schemas []string
+		for i, path := range []string{up, down, up} {
+			schemas = append(schemas, db.schema())
+
+			query, err := os.ReadFile(path)
+			if errors.Is(err, os.ErrNotExist) && path == down {
+				db.t.Fatalf("lmgtest: %s has no down migration %s", up, down)
+			}
+			if err != nil {
+				db.t.Fatalf("lmgtest: %s", err)
+			}
+
+			if err := ldb.Exec(ctx, string(query)); err != nil {
+				db.t.Fatalf("lmgtest: round trip of %s, step %d: exec %s: %s", up, i+1, path, err)
+			}
+		}
+
+		if after := db.schema(); schemas[2] != schemas[0] {
+			db.t.Fatalf("lmgtest: %s doesn't restore the schema from before %s\nbefore:\n%s\nafter down:\n%s", down, up, schemas[0], schemas[2])
+		} else if after != schemas[1] {
+			db.t.Fatalf("lmgtest: %s applied again gives a different schema\nfirst:\n%s\nagain:\n%s", up, schemas[1], after)
+		}
+	}
+}
+
+// schema describes every table, index, view and trigger, except lmg's own
+// and SQLite's, with the SQL that creates them.
+func (db *DB) schema() string {
+	db.t.Helper()
+
+	rows, err := db.SQL.Query(`
+		SELECT type, name, coalesce(sql, '') FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%' AND tbl_name NOT LIKE 'lmg_%'
+		ORDER BY type, name`)
+	if err != nil {
+		db.t.Fatalf("lmgtest: read schema: %s", err)
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	for rows.Next() {
+		var typ, name, sql string
+		if err := rows.Scan(&typ, &name, &sql); err != nil {
+			db.t.Fatalf("lmgtest: read schema: %s", err)
+		}
+		fmt.Fprintf(&b, "%s %s: %s\n", typ, name, sql)
+	}
+	if err := rows.Err(); err != nil {
+		db.t.Fatalf("lmgtest: read schema: %s", err)
+	}
+	return b.String()
+}
+
+// AssertTableExists reports an error if table doesn't exist.
+func (db *DB) AssertTableExists(table string) {
+	db.t.Helper()
+	if !db.exists("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?", table) {
+		db.t.Errorf("Expected table %q to be present", table)
+	}
+}
+
+// AssertTableNotExists reports an error if table exists.
+func (db *DB) AssertTableNotExists(table string) {
+	db.t.Helper()
+	if db.exists("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?", table) {
+		db.t.Errorf("Expected table %q to not be present", table)
+	}
+}
+
+// AssertColumnExists reports an error if table has no column called column.
+func (db *DB) AssertColumnExists(table, column string) {
+	db.t.Helper()
+	if !db.exists("SELECT 1 FROM pragma_table_info(?) WHERE name = ?", table, column) {
+		db.t.Errorf("Expected column %q on table %q to be present", column, table)
+	}
+}
+
+// AssertColumnNotExists reports an error if table has a column called column.
+func (db *DB) AssertColumnNotExists(table, column string) {
+	db.t.Helper()
+	if db.exists("SELECT 1 FROM pragma_table_info(?) WHERE name = ?", table, column) {
+		db.t.Errorf("Expected column %q on table %q to not be present", column, table)
+	}
+}
+
+// AssertIndexExists reports an error if table has no index called index.
+func (db *DB) AssertIndexExists(table, index string) {
+	db.t.Helper()
+	if !db.exists("SELECT 1 FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?", table, index) {
+		db.t.Errorf("Expected index %q on table %q to be present", index, table)
+	}
+}
+
+func (db *DB) exists(query string, args ...any) bool {
+	db.t.Helper()
+
+	var exists bool
+	if err := db.SQL.QueryRow(query, args...).Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false
+		}
+		db.t.Fatalf("lmgtest: %s", err)
+	}
+	return exists
+}
@@ -0,0 +1,63 @@
+package lmgtest_test
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ek-os/lmg/lmgtest"
+)
+
+func TestApply(t *testing.T) {
+	db := lmgtest.New(t)
+	db.Apply("testdata/changelog.txt")
+
+	db.AssertTableExists("users")
+	db.AssertColumnExists("users", "email")
+	db.AssertColumnNotExists("users", "last_name")
+	db.AssertIndexExists("users", "users_email")
+	db.AssertTableExists("lmg_history")
+}
+
+func TestRoundTrip(t *testing.T) {
+	db := lmgtest.New(t)
+	db.RoundTrip("testdata/changelog.txt")
+
+	db.AssertTableExists("users")
+	db.AssertColumnExists("users", "email")
+	db.AssertIndexExists("users", "users_email")
+}
+
+// fatalTB records the failure of a test instead of failing it.
+type fatalTB struct {
+	testing.TB
+	fatal string
+}
+
+func (tb *fatalTB) Fatalf(format string, args ...any) {
+	tb.fatal = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+func TestRoundTripDownMustRestoreSchema(t *testing.T) {
+	tb := &fatalTB{TB: t}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lmgtest.New(tb).RoundTrip("testdata/changelog-leaky.txt")
+	}()
+	<-done
+
+	if !strings.Contains(tb.fatal, "doesn't restore the schema") {
+		t.Errorf("Expected round trip to fail on leftover table, got: %q", tb.fatal)
+	}
+}
+
+func TestNewIsIsolated(t *testing.T) {
+	db := lmgtest.New(t)
+	db.Apply("testdata/changelog.txt")
+
+	lmgtest.New(t).AssertTableNotExists("users")
+}
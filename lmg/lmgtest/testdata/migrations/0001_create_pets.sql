@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS pets (id INTEGER PRIMARY KEY);
@@ -0,0 +1,4 @@
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY,
+    first_name TEXT NOT NULL
+);
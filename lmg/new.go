@@ -0,0 +1,146 @@
+package lmg
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ek-os/lmg/internal/lmgsql"
+)
+
+var migrationNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// newMigration creates an empty migration file, and optionally its down
+// counterpart, and appends it to the changelog.
+func newMigration(sys system, args []string) error {
+	var (
+		dir  string
+		seq  bool
+		down bool
+	)
+	fs := flag.NewFlagSet("lmg new", flag.ContinueOnError)
+	fs.StringVar(&dir, "dir", "migrations", "migrations directory, relative to the changelog")
+	fs.BoolVar(&seq, "seq", false, "prefix with a sequence number instead of a timestamp")
+	fs.BoolVar(&down, "down", false, "also create a down migration")
+	cfg, err := loadConfig(sys, fs, args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: lmg new [flags] <name>")
+	}
+	name := fs.Arg(0)
+	if !migrationNameRe.MatchString(name) {
+		return fmt.Errorf("invalid migration name %q: only letters, digits, '_' and '-' are allowed", name)
+	}
+
+	changelogPath := cfg.changelogPath
+	if changelogPath == "" {
+		return fmt.Errorf("%s is not set", ENV_CHANGELOG)
+	}
+	changelogDir := filepath.Dir(changelogPath)
+	migrationsDir := filepath.Join(changelogDir, dir)
+
+	if err := os.MkdirAll(migrationsDir, 0o755); err != nil {
+		return err
+	}
+
+	prefix := sys.Now().UTC().Format("20060102150405")
+	if seq {
+		n, err := nextSequence(migrationsDir)
+		if err != nil {
+			return err
+		}
+		prefix = fmt.Sprintf("%04d", n)
+	}
+
+	upPath := filepath.Join(migrationsDir, prefix+"_"+name+".sql")
+	paths := []string{upPath}
+	if down {
+		paths = append(paths, lmgsql.DownPath(upPath))
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	for _, path := range paths {
+		if err := createFile(path, fmt.Sprintf("-- %s\n", name)); err != nil {
+			return err
+		}
+		fmt.Fprintf(sys.Stdout(), "created %s\n", path)
+	}
+
+	line, err := filepath.Rel(changelogDir, upPath)
+	if err != nil {
+		return err
+	}
+	if err := appendChangelog(changelogPath, filepath.ToSlash(line)); err != nil {
+		return fmt.Errorf("append to changelog: %w", err)
+	}
+
+	return nil
+}
+
+// nextSequence returns one more than the highest numeric prefix among the
+// migrations in dir.
+func nextSequence(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	last := 0
+	for _, e := range entries {
+		prefix, _, ok := strings.Cut(e.Name(), "_")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(prefix); err == nil && n > last {
+			last = n
+		}
+	}
+	return last + 1, nil
+}
+
+func createFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func appendChangelog(path, line string) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		line = "\n" + line
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
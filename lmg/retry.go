@@ -0,0 +1,35 @@
+package lmg
+
+import (
+	"context"
+	"time"
+)
+
+const retryAttempts = 5
+
+// retryBackoff is the wait before the first retry, it doubles with every
+// further attempt.
+var retryBackoff = 100 * time.Millisecond
+
+// retry calls fn until it succeeds, returns an error for which isTransient is
+// false, runs out of attempts or ctx is done. Only operations that are safe to
+// repeat may be retried, migrations never are since they may have partially
+// applied.
+func retry(ctx context.Context, isTransient func(error) bool, fn func(context.Context) error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt == retryAttempts || !isTransient(err) {
+			return err
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,16 @@
+CREATE TABLE teams (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL
+);
+
+CREATE TABLE members (
+    id INTEGER PRIMARY KEY,
+    team_id INTEGER NOT NULL REFERENCES teams (id),
+    name TEXT NOT NULL,
+    nickname TEXT
+);
+
+CREATE INDEX members_team_id ON members (team_id);
+
+INSERT INTO teams (id, name) VALUES (1, 'core');
+INSERT INTO members (id, team_id, name, nickname) VALUES (1, 1, 'ek', 'e');
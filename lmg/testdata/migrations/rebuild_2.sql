@@ -0,0 +1,6 @@
+-- lmg:rebuild members
+CREATE TABLE members (
+    id INTEGER PRIMARY KEY,
+    team_id INTEGER NOT NULL REFERENCES teams (id) ON DELETE CASCADE,
+    name TEXT NOT NULL CHECK (name <> '')
+);
@@ -0,0 +1,5 @@
+CREATE TABLE slow AS
+WITH RECURSIVE counter(n) AS (
+    SELECT 1 UNION ALL SELECT n + 1 FROM counter LIMIT 1000000000
+)
+SELECT n FROM counter;
@@ -0,0 +1,7 @@
+-- Keep a count of users; the trigger body has its own statements.
+CREATE TABLE IF NOT EXISTS user_count (n INTEGER NOT NULL);
+
+CREATE TRIGGER IF NOT EXISTS users_count AFTER INSERT ON users
+BEGIN
+    UPDATE user_count SET n = n + 1; /* ; */
+END;
@@ -0,0 +1,94 @@
+package lmg
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ek-os/lmg/internal/lmgsql"
+)
+
+// validate checks the changelog without connecting to a database and reports
+// every problem it finds.
+func validate(sys system, args []string) error {
+	var checkSQL bool
+	fs := flag.NewFlagSet("lmg validate", flag.ContinueOnError)
+	fs.BoolVar(&checkSQL, "sql", false, "also split every migration into statements using the driver's dialect")
+	cfg, err := loadConfig(sys, fs, args)
+	if err != nil {
+		return err
+	}
+
+	var split lmgsql.Splitter
+	if checkSQL {
+		if split, err = lmgsql.NewSplitter(cfg.driver); err != nil {
+			return err
+		}
+	}
+
+	migrations, err := readChangelog(cfg.changelogPath)
+	if err != nil {
+		return fmt.Errorf("read changelog: %w", err)
+	}
+
+	var (
+		problems []error
+		dir      = filepath.Dir(cfg.changelogPath)
+		seen     = make(map[string]bool, len(migrations))
+	)
+	for _, migration := range migrations {
+		if seen[migration] {
+			problems = append(problems, fmt.Errorf("%s: listed more than once", migration))
+			continue
+		}
+		seen[migration] = true
+
+		if rel, err := filepath.Rel(dir, migration); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			problems = append(problems, fmt.Errorf("%s: outside of the changelog directory %s", migration, dir))
+			continue
+		}
+
+		if err := validateMigration(migration, split); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", migration, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Join(problems...)
+	}
+
+	fmt.Fprintf(sys.Stdout(), "%s: %d migrations ok\n", cfg.changelogPath, len(migrations))
+	return nil
+}
+
+func validateMigration(path string, split lmgsql.Splitter) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+
+	query, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	if split != nil {
+		if _, err := split(string(query)); err != nil {
+			return err
+		}
+	}
+	return nil
+}